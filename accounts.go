@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// how long to wait for the reply to a WHOIS
+const whoisTimeout = 10 * time.Second
+
+const RPL_WHOISACCOUNT = "330"
+
+// RPL_WHOISREGNICK is sent instead of RPL_WHOISACCOUNT by servers which only
+// know that the user identified for their current nick, e.g. RobustIRC.
+const RPL_WHOISREGNICK = "307"
+
+// accounts tracks which NickServ account users are logged in to. Accounts
+// are learned from account-tag, account-notify (ACCOUNT), extended-join and
+// WHOIS replies. Users who identified for their nick (RPL_WHOISREGNICK) are
+// logged in to the account of the same name. An entry is only trusted while the user shares a channel
+// with us: otherwise we would not notice them quitting and somebody else
+// taking their nick.
+var accounts = struct {
+	mtx sync.Mutex
+	// folded nick → account, "" for users known not to be logged in
+	m map[string]string
+	// folded nick → account from RPL_WHOISACCOUNT or RPL_WHOISREGNICK,
+	// until RPL_ENDOFWHOIS
+	whois map[string]string
+	// folded nick → pending WHOIS
+	pending map[string]*whoisLookup
+}{
+	m:       make(map[string]string),
+	whois:   make(map[string]string),
+	pending: make(map[string]*whoisLookup),
+}
+
+type whoisLookup struct {
+	timeout *time.Timer
+	waiting []func(account string, err error)
+}
+
+var errWhoisTimeout = errors.New("no reply to WHOIS")
+
+func setAccount(nick, account string) {
+	accounts.mtx.Lock()
+	defer accounts.mtx.Unlock()
+	accounts.m[fold(nick)] = account
+}
+
+func forgetAccount(nick string) {
+	accounts.mtx.Lock()
+	defer accounts.mtx.Unlock()
+	delete(accounts.m, fold(nick))
+}
+
+// knownAccount returns the account nick is logged in to ("" if none), if it
+// is known and can be trusted.
+func knownAccount(nick string) (account string, ok bool) {
+	accounts.mtx.Lock()
+	defer accounts.mtx.Unlock()
+	account, ok = accounts.m[fold(nick)]
+	return account, ok && len(ChannelsOf(nick)) > 0
+}
+
+// lookupAccount sends a WHOIS for nick and calls fn with the account from
+// the reply, or with an error if there is no reply in time. fn is called from
+// another goroutine and must not block.
+func lookupAccount(nick string, fn func(account string, err error)) {
+	key := fold(nick)
+	accounts.mtx.Lock()
+	defer accounts.mtx.Unlock()
+	if l, ok := accounts.pending[key]; ok {
+		l.waiting = append(l.waiting, fn)
+		return
+	}
+	l := &whoisLookup{waiting: []func(string, error){fn}}
+	l.timeout = time.AfterFunc(whoisTimeout, func() {
+		accounts.mtx.Lock()
+		if accounts.pending[key] != l {
+			accounts.mtx.Unlock()
+			return
+		}
+		delete(accounts.pending, key)
+		accounts.mtx.Unlock()
+		for _, fn := range l.waiting {
+			fn("", errWhoisTimeout)
+		}
+	})
+	accounts.pending[key] = l
+	Post("WHOIS " + nick)
+}
+
+// runnerAccounts keeps track of the accounts of users.
+func runnerAccounts(ctx context.Context, parsed *Message) error {
+	if capEnabled("account-tag") && parsed.Prefix != nil && parsed.Prefix.User != "" {
+		// without the tag, the user is not logged in
+		account, _ := parsed.Tag("account")
+		setAccount(Nick(parsed), account)
+	}
+
+	switch parsed.Command {
+	case irc.RPL_WELCOME:
+		// capability negotiation is over
+		checkAccountSource()
+
+	case "ACCOUNT":
+		// account-notify: the new account or * when logging out
+		account := parsed.Param(0)
+		if account == "*" {
+			account = ""
+		}
+		setAccount(Nick(parsed), account)
+
+	case irc.JOIN:
+		if len(parsed.Params) >= 3 {
+			// extended-join: JOIN #channel account :realname
+			account := parsed.Params[1]
+			if account == "*" {
+				account = ""
+			}
+			setAccount(Nick(parsed), account)
+		} else {
+			// they might have been somebody else while we could not
+			// see them
+			forgetAccount(Nick(parsed))
+		}
+
+	case irc.PART, irc.QUIT:
+		forgetAccount(Nick(parsed))
+
+	case irc.KICK:
+		forgetAccount(parsed.Param(1))
+
+	case irc.NICK:
+		accounts.mtx.Lock()
+		from, to := fold(Nick(parsed)), fold(parsed.Trailing())
+		account, ok := accounts.m[from]
+		delete(accounts.m, from)
+		if ok {
+			accounts.m[to] = account
+		} else {
+			delete(accounts.m, to)
+		}
+		accounts.mtx.Unlock()
+
+	case RPL_WHOISACCOUNT:
+		// <me> <nick> <account> :is logged in as
+		accounts.mtx.Lock()
+		accounts.whois[fold(parsed.Param(1))] = parsed.Param(2)
+		accounts.mtx.Unlock()
+
+	case RPL_WHOISREGNICK:
+		// <me> <nick> :has identified for this nick
+		nick := fold(parsed.Param(1))
+		accounts.mtx.Lock()
+		if _, ok := accounts.whois[nick]; !ok {
+			accounts.whois[nick] = parsed.Param(1)
+		}
+		accounts.mtx.Unlock()
+
+	case irc.RPL_ENDOFWHOIS:
+		nick := fold(parsed.Param(1))
+		accounts.mtx.Lock()
+		account := accounts.whois[nick]
+		delete(accounts.whois, nick)
+		accounts.m[nick] = account
+		l, ok := accounts.pending[nick]
+		if ok {
+			l.timeout.Stop()
+			delete(accounts.pending, nick)
+		}
+		accounts.mtx.Unlock()
+		if ok {
+			for _, fn := range l.waiting {
+				fn(account, nil)
+			}
+		}
+	}
+	return nil
+}
@@ -1,45 +1,289 @@
 package main
 
 import (
-	"log"
+	"expvar"
+	"fmt"
+	"strconv"
 	"strings"
-
-	"gopkg.in/sorcix/irc.v2"
+	"time"
 )
 
-func runnerAdmin(parsed *irc.Message) error {
-	if !IsPrivateQuery(parsed) {
-		return nil
-	}
+var adminModule = &Module{
+	Name:        "admin",
+	Description: "controls the bot",
+	AdminOnly:   true,
+}
 
-	n := Nick(parsed)
-	if !IsNickAdmin(parsed) {
-		// log.Printf("Not executing admin command for normal user %s", n)
-		return nil
-	}
+var adminCommands = []*Command{
+	{
+		Module:  "admin",
+		Name:    "msg",
+		Usage:   "<channel> <text>",
+		Help:    "posts text to a channel or user",
+		MinArgs: 2,
+		MaxArgs: 2,
+		Query:   true,
+		Role:    RoleOperator,
+		Run: func(inv *Invocation) error {
+			channel, msg := inv.Args[0], inv.Args[1]
+			Privmsg(channel, msg)
+			return nil
+		},
+	},
+	{
+		Module: "admin",
+		Name:   "reload",
+		Help:   "re-reads the config file",
+		Query:  true,
+		Role:   RoleOperator,
+		Run: func(inv *Invocation) error {
+			changes, err := reloadConfig()
+			if err != nil {
+				inv.Reply("Could not reload config, keeping the old one: " + err.Error())
+				return nil
+			}
+			for _, change := range changes {
+				inv.Reply("reload: " + change)
+			}
+			return nil
+		},
+	},
+	{
+		Module:  "admin",
+		Name:    "quit",
+		Aliases: []string{"exit"},
+		Help:    "makes the bot exit",
+		Query:   true,
+		Role:    RoleOwner,
+		Run: func(inv *Invocation) error {
+			inv.Reply("If you really want " + currentNick() + " to exit, type: REALLY_QUIT")
+			return nil
+		},
+	},
+	{
+		Module: "admin",
+		Name:   "REALLY_QUIT",
+		Help:   "exits without asking again",
+		Query:  true,
+		Role:   RoleOwner,
+		Run: func(inv *Invocation) error {
+			inv.Reply("As you wish.")
+			kill()
+			return nil
+		},
+	},
+	{
+		Module:  "admin",
+		Name:    "join",
+		Usage:   "<channel>",
+		Help:    "joins a channel until the next restart",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Query:   true,
+		Role:    RoleOperator,
+		Run: func(inv *Invocation) error {
+			channel, err := normalizeChannel(inv.Args[0])
+			if err != nil {
+				inv.Reply(err.Error())
+				return nil
+			}
+			Join(channel)
+			return nil
+		},
+	},
+	{
+		Module:  "admin",
+		Name:    "part",
+		Usage:   "<channel>",
+		Help:    "leaves a channel until the next restart",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Query:   true,
+		Role:    RoleOperator,
+		Run: func(inv *Invocation) error {
+			channel, err := normalizeChannel(inv.Args[0])
+			if err != nil {
+				inv.Reply(err.Error())
+				return nil
+			}
+			Part(channel)
+			return nil
+		},
+	},
+	{
+		Module:  "admin",
+		Name:    "nick",
+		Usage:   "<nick>",
+		Help:    "changes the nick until the next restart",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Query:   true,
+		Role:    RoleOperator,
+		Run: func(inv *Invocation) error {
+			setWantedNick(inv.Args[0])
+			return nil
+		},
+	},
+	{
+		Module:  "admin",
+		Name:    "raw",
+		Usage:   "<line>",
+		Help:    "sends a raw IRC line",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Query:   true,
+		Role:    RoleOwner,
+		Run: func(inv *Invocation) error {
+			Post(inv.Args[0])
+			return nil
+		},
+	},
+	{
+		Module: "admin",
+		Name:   "status",
+		Help:   "shows uptime, connection, channels and queue depth",
+		Query:  true,
+		Role:   RoleTrusted,
+		Run: func(inv *Invocation) error {
+			for _, line := range statusLines() {
+				inv.Reply(line)
+			}
+			return nil
+		},
+	},
+	{
+		Module: "admin",
+		Name:   "listeners",
+		Help:   "lists all listeners with their statistics",
+		Query:  true,
+		Role:   RoleTrusted,
+		Run: func(inv *Invocation) error {
+			for _, line := range listenerLines() {
+				inv.Reply(line)
+			}
+			return nil
+		},
+	},
+	{
+		Module:  "admin",
+		Name:    "enable",
+		Usage:   "<listener>",
+		Help:    "enables a listener disabled with disable",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Query:   true,
+		Role:    RoleOperator,
+		Run: func(inv *Invocation) error {
+			return toggleListener(inv, true)
+		},
+	},
+	{
+		Module:  "admin",
+		Name:    "disable",
+		Usage:   "<listener>",
+		Help:    "disables a listener in all channels until the next restart",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Query:   true,
+		Role:    RoleOperator,
+		Run: func(inv *Invocation) error {
+			return toggleListener(inv, false)
+		},
+	},
+	{
+		Module:   "admin",
+		Name:     "audit",
+		Usage:    "[count]",
+		Help:     "shows the most recent admin actions",
+		Examples: []string{"audit", "audit 20"},
+		MaxArgs:  1,
+		Query:    true,
+		Role:     RoleTrusted,
+		Run: func(inv *Invocation) error {
+			n := 10
+			if len(inv.Args) > 0 {
+				var err error
+				if n, err = strconv.Atoi(inv.Args[0]); err != nil || n < 1 {
+					inv.Reply("count must be a positive number")
+					return nil
+				}
+			}
+			if n > maxAuditLines {
+				n = maxAuditLines
+			}
+			entries, err := auditTrail(n)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				inv.Reply(e.String())
+			}
+			return nil
+		},
+	},
+}
 
-	msg := parsed.Trailing()
+// the audit command shows at most this many entries
+const maxAuditLines = 50
 
-	if strings.HasPrefix(msg, "msg ") {
-		cmd := strings.SplitN(msg, " ", 3)
-		if len(cmd) >= 3 {
-			channel := cmd[1]
-			msg = cmd[2]
+func statusLines() []string {
+	t, since, reconnects := connectionStatus()
+	lines := []string{
+		fmt.Sprintf("up %v, %d reconnects", time.Since(bootTimestamp).Round(time.Second), reconnects),
+	}
+	if t == nil {
+		lines = append(lines, "not connected")
+	} else {
+		lines = append(lines, fmt.Sprintf("connected for %v: %s", time.Since(since).Round(time.Second), t.ID()))
+	}
+	channels := ChannelsOf(currentNick())
+	if len(channels) == 0 {
+		channels = []string{"none"}
+	}
+	capabilities := enabledCaps()
+	if len(capabilities) == 0 {
+		capabilities = []string{"none"}
+	}
+	lines = append(lines,
+		"channels: "+strings.Join(channels, " "),
+		"capabilities: "+strings.Join(capabilities, " "),
+		fmt.Sprintf("outbound queue: %d lines", outbound.Len()))
+	return lines
+}
 
-			log.Printf("ADMIN %s: posting “%s” to %s", n, msg, channel)
-			Privmsg(channel, msg)
+func listenerLines() []string {
+	stat := func(l *Listener, name string) int64 {
+		if v, ok := l.stats.Get(name).(*expvar.Int); ok {
+			return v.Value()
 		}
+		return 0
 	}
-
-	if msg == "quit" || msg == "exit" {
-		Privmsg(Nick(parsed), "If you really want "+*nick+" to exit, type: REALLY_QUIT")
+	var lines []string
+	for _, l := range listeners {
+		line := fmt.Sprintf("%s: phase %s, timeout %v, created %s, %d runs, %d errors, %d timeouts, %d panics",
+			l.desc, l.phase, l.timeout, l.created,
+			stat(l, "runs"), stat(l, "errors"), stat(l, "timeouts"), stat(l, "panics"))
+		if l.concurrent {
+			line += ", concurrent"
+		}
+		if !listenerEnabled(l.desc) {
+			line += ", DISABLED"
+		}
+		lines = append(lines, line)
 	}
+	return lines
+}
 
-	if msg == "REALLY_QUIT" {
-		Privmsg(n, "As you wish.")
-		log.Printf("ADMIN %s: quitting", n)
-		kill()
+func toggleListener(inv *Invocation, enabled bool) error {
+	desc := inv.Args[0]
+	if err := setListenerEnabled(desc, enabled); err != nil {
+		inv.Reply(err.Error())
+		return nil
+	}
+	if enabled {
+		inv.Reply(desc + " enabled")
+	} else {
+		inv.Reply(desc + " disabled until the next restart, use enable to undo")
 	}
-
 	return nil
 }
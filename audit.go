@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var adminLog = newLogger("admin")
+
+// The audit trail records every admin action in the store. Only the most
+// recent auditKeep entries are kept.
+const (
+	auditNamespace = "audit"
+	auditKeep      = 1000
+)
+
+var auditSeq = struct {
+	mtx  sync.Mutex
+	last int64
+}{}
+
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Nick     string    `json:"nick"`
+	Hostmask string    `json:"hostmask"`
+	Action   string    `json:"action"`
+	Args     []string  `json:"args,omitempty"`
+}
+
+func (e auditEntry) String() string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s (%s): %s %s",
+		e.Time.Format("2006-01-02 15:04:05"), e.Nick, e.Hostmask, e.Action, strings.Join(e.Args, " ")))
+}
+
+// audit records that the sender of msg performed action. Passwords in the
+// arguments are redacted.
+func audit(msg *Message, action string, args ...string) {
+	e := auditEntry{
+		Time:   time.Now(),
+		Action: action,
+		Args:   redactArgs(action, args),
+	}
+	if msg.Prefix != nil {
+		e.Nick = Nick(msg)
+		e.Hostmask = msg.Prefix.User + "@" + Hostmask(msg)
+	}
+	adminLog.Info("admin action", "nick", e.Nick, "hostmask", e.Hostmask, "action", e.Action, "args", strings.Join(e.Args, " "))
+
+	auditSeq.mtx.Lock()
+	defer auditSeq.mtx.Unlock()
+	// keys sort in chronological order and are unique even if the clock
+	// did not advance
+	seq := e.Time.UnixNano()
+	if seq <= auditSeq.last {
+		seq = auditSeq.last + 1
+	}
+	auditSeq.last = seq
+	key := fmt.Sprintf("%020d", seq)
+	err := store.Update(func(tx Tx) error {
+		if err := putJSON(tx, auditNamespace, key, e); err != nil {
+			return err
+		}
+		var keys []string
+		err := tx.ForEach(auditNamespace, func(key string, _ []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for len(keys) > auditKeep {
+			if err := tx.Delete(auditNamespace, keys[0]); err != nil {
+				return err
+			}
+			keys = keys[1:]
+		}
+		return nil
+	})
+	if err != nil {
+		adminLog.Error("could not write audit trail", "err", err)
+	}
+}
+
+const redacted = "<redacted>"
+
+// redactArgs hides passwords in the arguments of the admin commands which
+// send something on frank’s behalf, e.g. “raw PASS hunter2”.
+func redactArgs(action string, args []string) []string {
+	switch {
+	case action == "raw" && len(args) == 1:
+		return []string{redactLine(args[0])}
+	case action == "msg" && len(args) == 2:
+		return []string{args[0], redactPrivmsg(args[0], args[1])}
+	}
+	return args
+}
+
+// redactLine hides the passwords in an IRC line before it is logged: those of
+// PASS, AUTHENTICATE and messages to NickServ, and those in uses of raw and
+// msg.
+func redactLine(line string) string {
+	var prefix string
+	if strings.HasPrefix(line, ":") {
+		if i := strings.IndexByte(line, ' '); i != -1 {
+			prefix, line = line[:i+1], line[i+1:]
+		}
+	}
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) < 2 {
+		return prefix + line
+	}
+	command, params := strings.ToUpper(fields[0]), fields[1]
+	switch command {
+	case "PASS", "AUTHENTICATE":
+		return prefix + fields[0] + " " + redacted
+	case "PRIVMSG":
+		target, text := params, ""
+		if i := strings.IndexByte(params, ' '); i != -1 {
+			target, text = params[:i], strings.TrimPrefix(params[i+1:], ":")
+		}
+		if redactedText := redactPrivmsg(target, text); redactedText != text {
+			return prefix + fields[0] + " " + target + " :" + redactedText
+		}
+	}
+	return prefix + line
+}
+
+// redactPrivmsg hides the passwords in text sent to target: everything but
+// the command of messages to NickServ (e.g. IDENTIFY), and the arguments of
+// raw and msg.
+func redactPrivmsg(target, text string) string {
+	if strings.EqualFold(target, "nickserv") {
+		if i := strings.IndexByte(text, ' '); i != -1 {
+			return text[:i+1] + redacted
+		}
+		return text
+	}
+	name, args, _ := parseCommand(text, currentNick())
+	var max int
+	switch strings.ToLower(name) {
+	case "raw":
+		max = 1
+	case "msg":
+		max = 2
+	default:
+		return text
+	}
+	redactedArgs := redactArgs(strings.ToLower(name), splitArgs(args, max))
+	return strings.TrimSpace(name + " " + strings.Join(redactedArgs, " "))
+}
+
+// auditTrail returns the last n entries of the audit trail, oldest first.
+func auditTrail(n int) ([]auditEntry, error) {
+	var entries []auditEntry
+	err := store.View(func(tx Tx) error {
+		return tx.ForEach(auditNamespace, func(key string, value []byte) error {
+			var e auditEntry
+			if err := json.Unmarshal(value, &e); err != nil {
+				return fmt.Errorf("audit entry %s: %v", key, err)
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	old := store
+	defer func() { store = old }()
+	store = newMemoryStore()
+
+	msg := parseMessage(":xeen!x@example.net PRIVMSG frank :join #test")
+	for i := 0; i < auditKeep+5; i++ {
+		audit(msg, "join", "#test"+strconv.Itoa(i))
+	}
+
+	entries, err := auditTrail(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, e := range entries {
+		if e.Nick != "xeen" || e.Hostmask != "x@example.net" || e.Action != "join" {
+			t.Errorf("unexpected audit entry %+v", e)
+		}
+		got = append(got, e.Args)
+	}
+	want := [][]string{
+		{"#test" + strconv.Itoa(auditKeep+3)},
+		{"#test" + strconv.Itoa(auditKeep+4)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("auditTrail(2) args = %q, want %q", got, want)
+	}
+
+	all, err := auditTrail(2 * auditKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != auditKeep {
+		t.Errorf("audit trail has %d entries, want %d", len(all), auditKeep)
+	}
+}
+
+func TestRedactLine(t *testing.T) {
+	for _, tc := range []struct {
+		line, want string
+	}{
+		{"PASS hunter2", "PASS <redacted>"},
+		{"AUTHENTICATE ZnJhbmsAZnJhbmsAaHVudGVyMg==", "AUTHENTICATE <redacted>"},
+		{"PRIVMSG NickServ :IDENTIFY frank hunter2", "PRIVMSG NickServ :IDENTIFY <redacted>"},
+		{"privmsg nickserv identify hunter2", "privmsg nickserv :identify <redacted>"},
+		{":xeen!x@example.net PRIVMSG frank :raw PASS hunter2", ":xeen!x@example.net PRIVMSG frank :raw PASS <redacted>"},
+		{":xeen!x@example.net PRIVMSG frank :msg NickServ IDENTIFY hunter2", ":xeen!x@example.net PRIVMSG frank :msg NickServ IDENTIFY <redacted>"},
+		{":xeen!x@example.net PRIVMSG frank :raw PRIVMSG nickserv :ghost frank hunter2", ":xeen!x@example.net PRIVMSG frank :raw PRIVMSG nickserv :ghost <redacted>"},
+		// nothing secret
+		{"PRIVMSG #test :PASS hunter2", "PRIVMSG #test :PASS hunter2"},
+		{":xeen!x@example.net PRIVMSG frank :msg #test hello", ":xeen!x@example.net PRIVMSG frank :msg #test hello"},
+		{"JOIN #test", "JOIN #test"},
+	} {
+		if got := redactLine(tc.line); got != tc.want {
+			t.Errorf("redactLine(%q) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestAuditRedacts(t *testing.T) {
+	old := store
+	defer func() { store = old }()
+	store = newMemoryStore()
+	buf, restore := captureLog()
+	defer restore()
+
+	msg := parseMessage(":xeen!x@example.net PRIVMSG frank :raw PASS hunter2")
+	audit(msg, "raw", "PASS hunter2")
+	audit(msg, "msg", "NickServ", "IDENTIFY frank hunter2")
+	entries, err := auditTrail(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.Contains(e.String(), "hunter2") {
+			t.Errorf("password in the audit trail: %s", e)
+		}
+	}
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("password logged: %s", buf)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+var authLog = newLogger("auth")
+
+// Role determines which commands a user may use. Every role includes the
+// permissions of the roles below it.
+type Role int
+
+const (
+	RoleNone Role = iota
+	// RoleTrusted may inspect the bot, e.g. using status.
+	RoleTrusted
+	// RoleOperator may run the bot, e.g. join channels.
+	RoleOperator
+	// RoleOwner may do anything, e.g. make the bot quit.
+	RoleOwner
+)
+
+var roleNames = map[Role]string{
+	RoleNone:     "none",
+	RoleTrusted:  "trusted",
+	RoleOperator: "operator",
+	RoleOwner:    "owner",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+func (r Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *Role) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	for role, name := range roleNames {
+		if role != RoleNone && name == s {
+			*r = role
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown role %q, must be owner, operator or trusted", s)
+}
+
+// AdminConfig identifies admins either by their NickServ account or by a
+// hostmask (nick!user@host) with * and ? wildcards. Hostmasks are only as
+// trustworthy as the hosts, prefer accounts or cloaks. A plain string in the
+// config file is an account with the owner role.
+type AdminConfig struct {
+	Account  string `json:"account,omitempty"`
+	Hostmask string `json:"hostmask,omitempty"`
+	Role     Role   `json:"role"`
+}
+
+func (a *AdminConfig) UnmarshalJSON(b []byte) error {
+	var account string
+	if err := json.Unmarshal(b, &account); err == nil {
+		*a = AdminConfig{Account: account, Role: RoleOwner}
+		return nil
+	}
+	// without the methods of AdminConfig, to not recurse
+	type plain AdminConfig
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(a))
+}
+
+func (a AdminConfig) String() string {
+	if a.Account != "" {
+		return fmt.Sprintf("account %s (%s)", a.Account, a.Role)
+	}
+	return fmt.Sprintf("hostmask %s (%s)", a.Hostmask, a.Role)
+}
+
+func (a AdminConfig) validate() error {
+	if (a.Account == "") == (a.Hostmask == "") {
+		return fmt.Errorf("exactly one of account and hostmask must be set")
+	}
+	if a.Hostmask != "" && (!strings.Contains(a.Hostmask, "!") || !strings.Contains(a.Hostmask, "@")) {
+		return fmt.Errorf("hostmask %q must look like nick!user@host", a.Hostmask)
+	}
+	if a.Role == RoleNone {
+		return fmt.Errorf("role must be owner, operator or trusted")
+	}
+	return nil
+}
+
+// matchMask reports whether s matches pattern, in which * matches any number
+// of characters and ? matches exactly one. The comparison ignores case
+// according to the server’s CASEMAPPING.
+func matchMask(pattern, s string) bool {
+	p, str := []rune(fold(pattern)), []rune(fold(s))
+	// position of the last * in p and the position in str it matched up to
+	star, match := -1, 0
+	i, j := 0, 0
+	for j < len(str) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == str[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, match = i, j
+			i++
+		case star >= 0:
+			// let the last * consume one more character
+			match++
+			i, j = star+1, match
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+// checkAccountSource warns if admins can only be recognized by their account,
+// but the server does not tell us accounts on its own. This is the case on
+// RobustIRC, which does not support capability negotiation: accounts are then
+// only looked up using WHOIS, and admins are not recognized unless its reply
+// contains the account, or says that they identified for their nick.
+func checkAccountSource() {
+	c := currentConfig()
+	if len(c.Admins) == 0 {
+		return
+	}
+	for _, a := range c.Admins {
+		if a.Hostmask != "" {
+			return
+		}
+	}
+	for _, name := range []string{"account-tag", "account-notify", "extended-join"} {
+		if capEnabled(name) {
+			return
+		}
+	}
+	authLog.Warn("admins are only configured by account, but the server does not announce accounts",
+		"transport", c.Transport,
+		"hint", "accounts are looked up using WHOIS; if the server only tells whether users identified for their nick (e.g. RobustIRC), admins must use a nick named like their account")
+}
+
+// userRole returns the role of the sender of msg. If it depends on their
+// NickServ account, which is not known yet, ok is false and the account is
+// looked up using WHOIS. The reply arrives only after the current message
+// has been processed, so the role is then passed to later, from another
+// goroutine. later must not block.
+func userRole(msg *Message, later func(Role)) (role Role, ok bool) {
+	if msg.Prefix == nil || msg.Prefix.Name == "" {
+		return RoleNone, true
+	}
+	c := currentConfig()
+
+	role = RoleNone
+	for _, a := range c.Admins {
+		if a.Role > role && a.Hostmask != "" && matchMask(a.Hostmask, msg.Prefix.String()) {
+			role = a.Role
+		}
+	}
+	needAccount := false
+	for _, a := range c.Admins {
+		if a.Role > role && a.Account != "" {
+			needAccount = true
+		}
+	}
+	if !needAccount {
+		return role, true
+	}
+
+	hostmaskRole := role
+	withAccount := func(account string) Role {
+		role := hostmaskRole
+		for _, a := range c.Admins {
+			if a.Role > role && a.Account != "" && equalFold(a.Account, account) {
+				role = a.Role
+			}
+		}
+		authLog.Debug("role determined", "prefix", msg.Prefix, "account", account, "role", role)
+		return role
+	}
+
+	if capEnabled("account-tag") {
+		// the server tells us for every message
+		account, _ := msg.Tag("account")
+		return withAccount(account), true
+	}
+	nick := Nick(msg)
+	if account, ok := knownAccount(nick); ok {
+		return withAccount(account), true
+	}
+	lookupAccount(nick, func(account string, err error) {
+		if err != nil {
+			authLog.Warn("could not look up the account", "nick", nick, "err", err)
+			later(hostmaskRole)
+			return
+		}
+		later(withAccount(account))
+	})
+	return RoleNone, false
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchMask(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*!*@nnev/staff/*", "xeen!x@nnev/staff/xeen", true},
+		{"*!*@nnev/staff/*", "xeen!x@nnev/staffer", false},
+		{"XEEN!*@*", "xeen!x@example.net", true},
+		{"x??n!*@*", "xeen!x@example.net", true},
+		{"x??n!*@*", "xen!x@example.net", false},
+		{"*", "", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"", "a", false},
+	} {
+		if got := matchMask(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("matchMask(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestAdminConfigJSON(t *testing.T) {
+	var got []AdminConfig
+	err := json.Unmarshal([]byte(`["xeen", {"hostmask": "*!*@nnev/staff/*", "role": "operator"}]`), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AdminConfig{
+		{Account: "xeen", Role: RoleOwner},
+		{Hostmask: "*!*@nnev/staff/*", Role: RoleOperator},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, bad := range []string{
+		`{"account": "xeen", "role": "god"}`,
+		`{"account": "xeen", "role": "none"}`,
+		`{"account": "xeen", "rolle": "owner"}`,
+	} {
+		var a AdminConfig
+		if err := json.Unmarshal([]byte(bad), &a); err == nil {
+			t.Errorf("Unmarshal(%s) accepted %+v", bad, a)
+		}
+	}
+
+	for _, invalid := range []AdminConfig{
+		{Role: RoleOwner},
+		{Account: "xeen", Hostmask: "*!*@*", Role: RoleOwner},
+		{Hostmask: "*.example.net", Role: RoleOwner},
+		{Account: "xeen"},
+	} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("%+v is valid", invalid)
+		}
+	}
+}
+
+func TestUserRole(t *testing.T) {
+	c := defaultConfig()
+	c.Admins = []AdminConfig{
+		{Account: "xeen", Role: RoleOwner},
+		{Hostmask: "*!*@nnev/staff/*", Role: RoleOperator},
+		{Hostmask: "*!*@trusted.example.net", Role: RoleTrusted},
+	}
+	withConfig(t, c)
+
+	withOutbound(t, 10)
+
+	noLater := func(role Role) { t.Errorf("unexpected account lookup, got role %s", role) }
+
+	// eve is no admin, but an account could make her one
+	roles := make(chan Role, 1)
+	if role, ok := userRole(parseMessage(":eve!e@example.net PRIVMSG frank :hi"), func(role Role) { roles <- role }); ok {
+		t.Errorf("userRole(eve) = %s without looking up the account", role)
+	}
+	outbound.pop()
+	runnerAccounts(nil, parseMessage(":server 318 frank eve :End of /WHOIS list."))
+	if role := <-roles; role != RoleNone {
+		t.Errorf("role of eve = %s, want none", role)
+	}
+
+	// account known from account-notify, while sharing a channel with us
+	runnerMembers(nil, parseMessage(":xeen!x@example.net JOIN #test"))
+	defer chanState.quit("xeen")
+	runnerAccounts(nil, parseMessage(":xeen!x@example.net ACCOUNT xeen"))
+	if role, ok := userRole(parseMessage(":xeen!x@example.net PRIVMSG frank :hi"), noLater); !ok || role != RoleOwner {
+		t.Errorf("userRole(xeen) = %s, %v, want owner", role, ok)
+	}
+
+	// unknown account: looked up using WHOIS
+	roles = make(chan Role, 1)
+	msg := parseMessage(":staffer!s@nnev/staff/staffer PRIVMSG frank :hi")
+	if role, ok := userRole(msg, func(role Role) { roles <- role }); ok {
+		t.Fatalf("userRole(staffer) = %s without looking up the account", role)
+	}
+	if line, _ := outbound.peek(); line != "WHOIS staffer" {
+		t.Errorf("sent %q, want WHOIS", line)
+	}
+	runnerAccounts(nil, parseMessage(":server 330 frank staffer xeen :is logged in as"))
+	runnerAccounts(nil, parseMessage(":server 318 frank staffer :End of /WHOIS list."))
+	select {
+	case role := <-roles:
+		if role != RoleOwner {
+			t.Errorf("role of staffer = %s, want owner", role)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no role after the WHOIS reply")
+	}
+
+	// servers which only tell that the user identified for their nick
+	runnerAccounts(nil, parseMessage(":xeen!x@example.net QUIT :bye"))
+	roles = make(chan Role, 1)
+	if _, ok := userRole(parseMessage(":xeen!x@robust/0x1 PRIVMSG frank :hi"), func(role Role) { roles <- role }); ok {
+		t.Fatalf("userRole(xeen) without looking up the account")
+	}
+	runnerAccounts(nil, parseMessage(":server 307 frank xeen :has identified for this nick"))
+	runnerAccounts(nil, parseMessage(":server 318 frank xeen :End of /WHOIS list."))
+	select {
+	case role := <-roles:
+		if role != RoleOwner {
+			t.Errorf("role of identified xeen = %s, want owner", role)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no role after the WHOIS reply")
+	}
+
+	// the account is only trusted while staffer shares a channel with us
+	roles = make(chan Role, 1)
+	if _, ok := userRole(msg, func(role Role) { roles <- role }); ok {
+		t.Errorf("userRole(staffer) trusted the account of a user in no channel")
+	}
+	runnerAccounts(nil, parseMessage(":server 318 frank staffer :End of /WHOIS list."))
+	if role := <-roles; role != RoleOperator {
+		t.Errorf("role of logged out staffer = %s, want operator from the hostmask", role)
+	}
+}
+
+func TestCheckAccountSource(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+
+	// RobustIRC: no capabilities
+	c := defaultConfig()
+	c.Admins = []AdminConfig{{Account: "xeen", Role: RoleOwner}}
+	withConfig(t, c)
+	runnerAccounts(nil, parseMessage(":robustirc.net 001 frank :Welcome to RobustIRC!"))
+	if !strings.Contains(buf.String(), "level=warn module=auth") {
+		t.Errorf("no warning about the missing account source, logged:\n%s", buf)
+	}
+
+	buf.Reset()
+	c = defaultConfig()
+	c.Admins = []AdminConfig{{Account: "xeen", Role: RoleOwner}, {Hostmask: "*!*@nnev/staff/*", Role: RoleOperator}}
+	setConfig(c)
+	checkAccountSource()
+	if buf.Len() > 0 {
+		t.Errorf("warned although there is an admin by hostmask:\n%s", buf)
+	}
+}
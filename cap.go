@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// wantedCaps are the IRCv3 capabilities frank requests if the server offers
+// them. sasl is requested in addition if configured.
+var wantedCaps = []string{
+	"account-notify",
+	"account-tag",
+	"away-notify",
+	"extended-join",
+	"message-tags",
+	"multi-prefix",
+	"server-time",
+}
+
+// SASL numerics, see https://ircv3.net/specs/extensions/sasl-3.1
+const (
+	RPL_LOGGEDIN    = "900"
+	RPL_SASLSUCCESS = "903"
+	ERR_SASLFAIL    = "904"
+	ERR_SASLTOOLONG = "905"
+	ERR_SASLABORTED = "906"
+	ERR_SASLALREADY = "907"
+)
+
+// AUTHENTICATE payloads are sent in chunks of this many bytes
+const saslChunkSize = 400
+
+// caps tracks the capability negotiation of the current connection.
+var caps = struct {
+	mtx sync.Mutex
+	// offered collects the capabilities from CAP LS, which may span
+	// multiple lines: name → value
+	offered map[string]string
+	enabled map[string]bool
+	// negotiating is set from CAP LS until CAP END
+	negotiating bool
+}{
+	offered: make(map[string]string),
+	enabled: make(map[string]bool),
+}
+
+// startCapNegotiation asks the server for its capabilities. The server
+// suspends registration until we send CAP END.
+func startCapNegotiation() {
+	caps.mtx.Lock()
+	caps.offered = make(map[string]string)
+	caps.enabled = make(map[string]bool)
+	caps.negotiating = true
+	caps.mtx.Unlock()
+	Post("CAP LS 302")
+}
+
+// endCapNegotiation lets the server continue with the registration.
+func endCapNegotiation() {
+	caps.mtx.Lock()
+	negotiating := caps.negotiating
+	caps.negotiating = false
+	caps.mtx.Unlock()
+	if negotiating {
+		Post("CAP END")
+	}
+}
+
+// capEnabled reports whether the server acknowledged the capability name.
+func capEnabled(name string) bool {
+	caps.mtx.Lock()
+	defer caps.mtx.Unlock()
+	return caps.enabled[name]
+}
+
+func enabledCaps() []string {
+	caps.mtx.Lock()
+	defer caps.mtx.Unlock()
+	var names []string
+	for name := range caps.enabled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// requestCaps returns the capabilities to request out of offered.
+func requestCaps(offered map[string]string, sasl SASLConfig) []string {
+	var req []string
+	for _, name := range wantedCaps {
+		if _, ok := offered[name]; ok {
+			req = append(req, name)
+		}
+	}
+	if mechanisms, ok := offered["sasl"]; ok && sasl.Mechanism != "" {
+		// the value lists the supported mechanisms since CAP LS 302
+		if mechanisms == "" || IsIn(strings.ToUpper(sasl.Mechanism), strings.Split(mechanisms, ",")) {
+			req = append(req, "sasl")
+		} else {
+			ircLog.Warn("SASL mechanism not supported by the server", "mechanism", sasl.Mechanism, "supported", mechanisms)
+		}
+	}
+	return req
+}
+
+// saslPayload returns the AUTHENTICATE payload for the configured mechanism,
+// split into chunks.
+func saslPayload(c *Config) []string {
+	if c.SASL.Mechanism == "external" {
+		// the account is taken from the client certificate
+		return []string{"+"}
+	}
+	account := c.SASL.Account
+	if account == "" {
+		account = c.Nick
+	}
+	password := c.SASL.Password
+	if password == "" {
+		password = c.NickservPassword
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(account + "\x00" + account + "\x00" + password))
+	var chunks []string
+	for len(encoded) >= saslChunkSize {
+		chunks = append(chunks, encoded[:saslChunkSize])
+		encoded = encoded[saslChunkSize:]
+	}
+	// an empty chunk ("+") signals the end if the last one was full
+	if encoded == "" {
+		encoded = "+"
+	}
+	return append(chunks, encoded)
+}
+
+// runnerCap negotiates capabilities and authenticates using SASL.
+func runnerCap(ctx context.Context, parsed *Message) error {
+	switch parsed.Command {
+	case irc.CAP:
+		// CAP <nick or *> <subcommand> [*] :<capabilities>
+		more := len(parsed.Params) > 3 && parsed.Param(2) == "*"
+		list := strings.Fields(parsed.Trailing())
+		switch strings.ToUpper(parsed.Param(1)) {
+		case "LS":
+			caps.mtx.Lock()
+			for _, c := range list {
+				kv := strings.SplitN(c, "=", 2)
+				caps.offered[kv[0]] = ""
+				if len(kv) == 2 {
+					caps.offered[kv[0]] = kv[1]
+				}
+			}
+			offered := caps.offered
+			caps.mtx.Unlock()
+			if more {
+				return nil
+			}
+			req := requestCaps(offered, currentConfig().SASL)
+			if len(req) == 0 {
+				endCapNegotiation()
+				return nil
+			}
+			Post("CAP REQ :" + strings.Join(req, " "))
+
+		case "ACK":
+			caps.mtx.Lock()
+			for _, c := range list {
+				if strings.HasPrefix(c, "-") {
+					delete(caps.enabled, c[1:])
+				} else {
+					caps.enabled[c] = true
+				}
+			}
+			negotiating := caps.negotiating
+			caps.mtx.Unlock()
+			ircLog.Info("enabled capabilities", "caps", strings.Join(enabledCaps(), " "))
+			if negotiating && IsIn("sasl", list) {
+				Post("AUTHENTICATE " + strings.ToUpper(currentConfig().SASL.Mechanism))
+				return nil
+			}
+			endCapNegotiation()
+
+		case "NAK":
+			ircLog.Warn("server refused capabilities", "caps", parsed.Trailing())
+			endCapNegotiation()
+
+		case "NEW":
+			// cap-notify, implied by CAP LS 302
+			offered := make(map[string]string)
+			for _, c := range list {
+				offered[strings.SplitN(c, "=", 2)[0]] = ""
+			}
+			// SASL only works during registration
+			if req := requestCaps(offered, SASLConfig{}); len(req) > 0 {
+				Post("CAP REQ :" + strings.Join(req, " "))
+			}
+
+		case "DEL":
+			caps.mtx.Lock()
+			for _, c := range list {
+				delete(caps.enabled, c)
+			}
+			caps.mtx.Unlock()
+		}
+
+	case "AUTHENTICATE":
+		if parsed.Param(0) != "+" {
+			return nil
+		}
+		for _, chunk := range saslPayload(currentConfig()) {
+			Post("AUTHENTICATE " + chunk)
+		}
+
+	case RPL_LOGGEDIN:
+		ircLog.Info("logged in", "account", parsed.Param(2))
+
+	case RPL_SASLSUCCESS:
+		ircLog.Info("SASL authentication successful")
+		endCapNegotiation()
+
+	case ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED, ERR_SASLALREADY:
+		ircLog.Warn("SASL authentication failed, continuing without", "reason", parsed.Trailing())
+		endCapNegotiation()
+
+	case irc.RPL_WELCOME:
+		// servers without capability negotiation just register us
+		caps.mtx.Lock()
+		caps.negotiating = false
+		caps.mtx.Unlock()
+	}
+	return nil
+}
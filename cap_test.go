@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCapNegotiation(t *testing.T) {
+	c := defaultConfig()
+	c.Transport = "irc"
+	c.Nick = "frank"
+	c.SASL = SASLConfig{Mechanism: "plain", Password: "secret"}
+	withConfig(t, c)
+
+	withOutbound(t, 10)
+	defer func() {
+		caps.mtx.Lock()
+		defer caps.mtx.Unlock()
+		caps.enabled = make(map[string]bool)
+		caps.negotiating = false
+	}()
+
+	sent := func() []string {
+		var lines []string
+		for {
+			line, ok := outbound.peek()
+			if !ok {
+				return lines
+			}
+			outbound.pop()
+			lines = append(lines, line)
+		}
+	}
+	exchange := func(line string, want ...string) {
+		t.Helper()
+		if err := runnerCap(nil, parseMessage(line)); err != nil {
+			t.Fatal(err)
+		}
+		if got := sent(); !reflect.DeepEqual(got, want) {
+			t.Errorf("after %q, sent %q, want %q", line, got, want)
+		}
+	}
+
+	startCapNegotiation()
+	if got := sent(); !reflect.DeepEqual(got, []string{"CAP LS 302"}) {
+		t.Errorf("sent %q, want CAP LS", got)
+	}
+	exchange(":irc.example.net CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL server-time")
+	exchange(":irc.example.net CAP * LS :account-tag chghost",
+		"CAP REQ :account-tag multi-prefix server-time sasl")
+	exchange(":irc.example.net CAP * ACK :account-tag multi-prefix server-time sasl",
+		"AUTHENTICATE PLAIN")
+	payload := base64.StdEncoding.EncodeToString([]byte("frank\x00frank\x00secret"))
+	exchange("AUTHENTICATE +", "AUTHENTICATE "+payload)
+	exchange(":irc.example.net 900 frank frank!bot@example.net frank :You are now logged in as frank")
+	exchange(":irc.example.net 903 frank :SASL authentication successful", "CAP END")
+
+	if !capEnabled("account-tag") || capEnabled("away-notify") {
+		t.Errorf("enabled capabilities = %q", enabledCaps())
+	}
+	exchange(":irc.example.net CAP frank DEL :account-tag")
+	if capEnabled("account-tag") {
+		t.Errorf("account-tag still enabled after CAP DEL")
+	}
+	exchange(":irc.example.net CAP frank NEW :away-notify sasl", "CAP REQ :away-notify")
+
+	// failed authentication does not block the registration
+	startCapNegotiation()
+	sent()
+	exchange(":irc.example.net CAP * LS :sasl", "CAP REQ :sasl")
+	exchange(":irc.example.net CAP * ACK :sasl", "AUTHENTICATE PLAIN")
+	exchange(":irc.example.net 904 frank :SASL authentication failed", "CAP END")
+
+	// nothing to request
+	startCapNegotiation()
+	sent()
+	exchange(":irc.example.net CAP * LS :chghost", "CAP END")
+}
+
+func TestSASLPayload(t *testing.T) {
+	c := defaultConfig()
+	c.Nick = "frank"
+	c.NickservPassword = "nickserv"
+	c.SASL = SASLConfig{Mechanism: "plain"}
+	if got, want := saslPayload(c), []string{base64.StdEncoding.EncodeToString([]byte("frank\x00frank\x00nickserv"))}; !reflect.DeepEqual(got, want) {
+		t.Errorf("saslPayload() = %q, want %q", got, want)
+	}
+
+	// 300 bytes encode to exactly 400, which needs a final "+"
+	c.SASL = SASLConfig{Mechanism: "plain", Account: "a", Password: strings.Repeat("p", 300-len("a\x00a\x00"))}
+	got := saslPayload(c)
+	if len(got) != 2 || len(got[0]) != saslChunkSize || got[1] != "+" {
+		t.Errorf("saslPayload() = %q, want one full chunk and +", got)
+	}
+
+	c.SASL = SASLConfig{Mechanism: "external"}
+	if got := saslPayload(c); !reflect.DeepEqual(got, []string{"+"}) {
+		t.Errorf("saslPayload() = %q for external, want +", got)
+	}
+}
+
+func TestAccountTag(t *testing.T) {
+	c := defaultConfig()
+	c.Admins = []AdminConfig{{Account: "xeen", Role: RoleOwner}}
+	withConfig(t, c)
+
+	caps.mtx.Lock()
+	caps.enabled = map[string]bool{"account-tag": true}
+	caps.mtx.Unlock()
+	defer func() {
+		caps.mtx.Lock()
+		defer caps.mtx.Unlock()
+		caps.enabled = make(map[string]bool)
+	}()
+
+	noLater := func(role Role) { t.Errorf("unexpected account lookup, got role %s", role) }
+	for line, want := range map[string]Role{
+		"@account=xeen :nick!x@example.net PRIVMSG frank :status": RoleOwner,
+		"@account=eve :xeen!x@example.net PRIVMSG frank :status":  RoleNone,
+		":xeen!x@example.net PRIVMSG frank :status":               RoleNone,
+	} {
+		if role, ok := userRole(parseMessage(line), noLater); !ok || role != want {
+			t.Errorf("userRole(%q) = %s, %v, want %s", line, role, ok, want)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// channelsLog logs joins, parts and the like as one entry per channel. The
+// full state is available at /debug/channels instead.
+var channelsLog = newLogger("channels")
+
+// channelState is what frank knows about a channel it is in.
+type channelState struct {
+	// name as the server last spelled it
+	name string
+	// folded nick → member
+	members map[string]*member
+	// names collects RPL_NAMREPLY until RPL_ENDOFNAMES replaces members
+	// with it, nil if no NAMES reply is in progress
+	names map[string]*member
+	// synced is set once the member list is complete (RPL_ENDOFNAMES)
+	synced bool
+	// channel modes which are not lists: mode → parameter ("" if none)
+	modes map[byte]string
+
+	topic      string
+	topicSetBy string
+	topicSetAt time.Time
+}
+
+type member struct {
+	nick string
+	// modes are the membership modes, e.g. "ov"
+	modes string
+}
+
+// channelTracker tracks the channels frank is in, with their members, modes
+// and topics. Nicks and channels are compared according to the server’s
+// CASEMAPPING, but reported as the server last spelled them. All methods are
+// safe for concurrent use.
+type channelTracker struct {
+	mtx sync.RWMutex
+	// folded channel → state
+	m map[string]*channelState
+}
+
+func newChannelTracker() *channelTracker {
+	return &channelTracker{m: make(map[string]*channelState)}
+}
+
+var chanState = newChannelTracker()
+
+// channel returns the state of channel, creating it if create is set. mtx
+// must be held.
+func (t *channelTracker) channel(name string, create bool) *channelState {
+	key := fold(name)
+	c := t.m[key]
+	if c == nil && create {
+		c = &channelState{
+			name:    name,
+			members: make(map[string]*member),
+			modes:   make(map[byte]string),
+		}
+		t.m[key] = c
+	}
+	return c
+}
+
+// joined starts tracking channel from scratch, after frank joined it.
+func (t *channelTracker) joined(channel string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.m, fold(channel))
+	t.channel(channel, true)
+}
+
+// left stops tracking channel, after frank parted or was kicked.
+func (t *channelTracker) left(channel string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.m, fold(channel))
+}
+
+func (t *channelTracker) add(nick, channel string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	c := t.channel(channel, true)
+	c.name = channel
+	if _, ok := c.members[fold(nick)]; !ok {
+		c.members[fold(nick)] = &member{nick: nick}
+	}
+}
+
+func (t *channelTracker) remove(nick, channel string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if c := t.channel(channel, false); c != nil {
+		delete(c.members, fold(nick))
+	}
+}
+
+// quit removes nick from all channels.
+func (t *channelTracker) quit(nick string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	nick = fold(nick)
+	for _, c := range t.m {
+		delete(c.members, nick)
+	}
+}
+
+func (t *channelTracker) rename(from, to string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	from = fold(from)
+	for _, c := range t.m {
+		m, ok := c.members[from]
+		if !ok {
+			continue
+		}
+		delete(c.members, from)
+		m.nick = to
+		c.members[fold(to)] = m
+	}
+}
+
+// namReply records the members from one RPL_NAMREPLY line, which may be
+// prefixed with their membership prefixes, e.g. "@frank".
+func (t *channelTracker) namReply(channel string, names []string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	c := t.channel(channel, false)
+	if c == nil {
+		// e.g. /NAMES for a channel we are not in
+		return
+	}
+	if c.names == nil {
+		c.names = make(map[string]*member)
+	}
+	for _, name := range names {
+		prefixes, nick := stripPrefixes(name)
+		if nick == "" {
+			continue
+		}
+		m := &member{nick: nick}
+		for i := 0; i < len(prefixes); i++ {
+			if mode, ok := prefixMode(prefixes[i]); ok {
+				m.modes += string(mode)
+			}
+		}
+		c.names[fold(nick)] = m
+	}
+}
+
+// endOfNames replaces the members of channel with those from the preceding
+// RPL_NAMREPLY lines, which drops members we missed leaving. It returns the
+// number of members, and false if channel is not tracked.
+func (t *channelTracker) endOfNames(channel string) (n int, ok bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	c := t.channel(channel, false)
+	if c == nil {
+		return 0, false
+	}
+	if c.names != nil {
+		c.members = c.names
+		c.names = nil
+	}
+	c.synced = true
+	return len(c.members), true
+}
+
+// mode applies a MODE change or RPL_CHANNELMODEIS, e.g. "+o-v" with the
+// parameters "alice" and "bob".
+func (t *channelTracker) mode(channel, change string, params []string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	c := t.channel(channel, false)
+	if c == nil {
+		return
+	}
+	adding := true
+	for i := 0; i < len(change); i++ {
+		mode := change[i]
+		switch mode {
+		case '+':
+			adding = true
+			continue
+		case '-':
+			adding = false
+			continue
+		}
+		var param string
+		if modeTakesParam(mode, adding) {
+			if len(params) == 0 {
+				channelsLog.Warn("missing parameter in MODE", "channel", channel, "change", change, "mode", string(mode))
+				return
+			}
+			param, params = params[0], params[1:]
+		}
+		switch {
+		case isPrefixMode(mode):
+			m, ok := c.members[fold(param)]
+			if !ok {
+				continue
+			}
+			m.modes = strings.Replace(m.modes, string(mode), "", -1)
+			if adding {
+				m.modes += string(mode)
+			}
+		case isListMode(mode):
+			// bans and the like are not tracked
+		case adding:
+			c.modes[mode] = param
+		default:
+			delete(c.modes, mode)
+		}
+	}
+}
+
+// resetModes forgets the channel modes before RPL_CHANNELMODEIS lists all
+// of them.
+func (t *channelTracker) resetModes(channel string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if c := t.channel(channel, false); c != nil {
+		c.modes = make(map[byte]string)
+	}
+}
+
+func (t *channelTracker) setTopic(channel, topic, setBy string, setAt time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if c := t.channel(channel, false); c != nil {
+		c.topic, c.topicSetBy, c.topicSetAt = topic, setBy, setAt
+	}
+}
+
+// setTopicWho records who set the topic, from RPL_TOPICWHOTIME.
+func (t *channelTracker) setTopicWho(channel, setBy string, setAt time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if c := t.channel(channel, false); c != nil {
+		c.topicSetBy, c.topicSetAt = setBy, setAt
+	}
+}
+
+func (t *channelTracker) IsMember(nick, channel string) bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	c := t.channel(channel, false)
+	if c == nil {
+		return false
+	}
+	_, ok := c.members[fold(nick)]
+	return ok
+}
+
+// IsOp reports whether nick is an operator (or higher, e.g. owner) in
+// channel.
+func (t *channelTracker) IsOp(nick, channel string) bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	c := t.channel(channel, false)
+	if c == nil {
+		return false
+	}
+	m, ok := c.members[fold(nick)]
+	if !ok {
+		return false
+	}
+	isupport.mtx.RLock()
+	defer isupport.mtx.RUnlock()
+	// prefixModes are sorted from highest to lowest
+	op := strings.IndexByte(isupport.prefixModes, 'o')
+	for i := 0; i < len(m.modes); i++ {
+		if rank := strings.IndexByte(isupport.prefixModes, m.modes[i]); rank != -1 && rank <= op {
+			return true
+		}
+	}
+	return false
+}
+
+// Members returns the nicks in channel, sorted.
+func (t *channelTracker) Members(channel string) []string {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	c := t.channel(channel, false)
+	if c == nil {
+		return nil
+	}
+	nicks := make([]string, 0, len(c.members))
+	for _, m := range c.members {
+		nicks = append(nicks, m.nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+func (t *channelTracker) channelsOf(nick string) []string {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	nick = fold(nick)
+	var result []string
+	for _, c := range t.m {
+		if _, ok := c.members[nick]; ok {
+			result = append(result, c.name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// ChannelInfo is a copy of the state of a channel.
+type ChannelInfo struct {
+	Name   string `json:"name"`
+	Synced bool   `json:"synced"`
+	// Modes are the channel modes, e.g. "+nt", without parameters
+	Modes      string    `json:"modes"`
+	Topic      string    `json:"topic"`
+	TopicSetBy string    `json:"topic_set_by,omitempty"`
+	TopicSetAt time.Time `json:"topic_set_at,omitempty"`
+	// Members maps nicks to their membership modes, e.g. "o"
+	Members map[string]string `json:"members"`
+}
+
+// Info returns a copy of the state of all channels, sorted by name.
+func (t *channelTracker) Info() []ChannelInfo {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	var infos []ChannelInfo
+	for _, c := range t.m {
+		var modes []byte
+		for mode := range c.modes {
+			modes = append(modes, mode)
+		}
+		sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+		info := ChannelInfo{
+			Name:       c.name,
+			Synced:     c.synced,
+			Modes:      "+" + string(modes),
+			Topic:      c.topic,
+			TopicSetBy: c.topicSetBy,
+			TopicSetAt: c.topicSetAt,
+			Members:    make(map[string]string),
+		}
+		for _, m := range c.members {
+			info.Members[m.nick] = m.modes
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func runnerMembers(ctx context.Context, parsed *Message) error {
+	switch parsed.Command {
+	case irc.RPL_NAMREPLY:
+		if len(parsed.Params) < 4 {
+			return nil
+		}
+		// parsed.Params[0] is my own nick
+		// parsed.Params[1] is a sigil for the channel (“=” public, “@” secret, …)
+		// parsed.Params[2] is the name of the channel
+		// parsed.Params[3] (or parsed.Trailing()) are the space-separated nicknames
+		chanState.namReply(parsed.Params[2], strings.Fields(parsed.Trailing()))
+	case irc.RPL_ENDOFNAMES:
+		channel := parsed.Param(1)
+		if n, ok := chanState.endOfNames(channel); ok {
+			channelsLog.Info("synced", "channel", channel, "members", n)
+		}
+	case irc.PART:
+		channel, nick := Target(parsed), Nick(parsed)
+		if isMe(nick) {
+			chanState.left(channel)
+		} else {
+			chanState.remove(nick, channel)
+		}
+		channelsLog.Info("part", "channel", channel, "nick", nick)
+	case irc.KICK:
+		channel, nick := parsed.Param(0), parsed.Param(1)
+		if isMe(nick) {
+			chanState.left(channel)
+		} else {
+			chanState.remove(nick, channel)
+		}
+		channelsLog.Info("kick", "channel", channel, "nick", nick, "by", Nick(parsed), "reason", parsed.Trailing())
+	case irc.QUIT:
+		nick := Nick(parsed)
+		// one event per channel, the channels are gone afterwards
+		channels := ChannelsOf(nick)
+		chanState.quit(nick)
+		for _, channel := range channels {
+			channelsLog.Info("quit", "channel", channel, "nick", nick)
+		}
+	case irc.JOIN:
+		// not Trailing(): with extended-join, account and realname follow
+		channel := parsed.Param(0)
+		nick := Nick(parsed)
+		if isMe(nick) {
+			chanState.joined(channel)
+			// RPL_NAMREPLY follows by itself, the modes need to be
+			// asked for
+			Post("MODE " + channel)
+		}
+		chanState.add(nick, channel)
+		channelsLog.Info("join", "channel", channel, "nick", nick)
+	case irc.NICK:
+		from, to := Nick(parsed), parsed.Trailing()
+		channels := ChannelsOf(from)
+		chanState.rename(from, to)
+		for _, channel := range channels {
+			channelsLog.Info("nick", "channel", channel, "nick", from, "new", to)
+		}
+	case irc.MODE:
+		if !isChannel(parsed.Param(0)) || len(parsed.Params) < 2 {
+			// user modes
+			return nil
+		}
+		chanState.mode(parsed.Params[0], parsed.Params[1], parsed.Params[2:])
+	case irc.RPL_CHANNELMODEIS:
+		// <me> <channel> <modes> [<parameters>…]
+		if len(parsed.Params) < 3 {
+			return nil
+		}
+		chanState.resetModes(parsed.Params[1])
+		chanState.mode(parsed.Params[1], parsed.Params[2], parsed.Params[3:])
+	case irc.TOPIC:
+		chanState.setTopic(parsed.Param(0), parsed.Trailing(), Nick(parsed), parsed.Time)
+	case irc.RPL_TOPIC:
+		chanState.setTopic(parsed.Param(1), parsed.Trailing(), "", time.Time{})
+	case irc.RPL_NOTOPIC:
+		chanState.setTopic(parsed.Param(1), "", "", time.Time{})
+	case irc.RPL_TOPICWHOTIME:
+		// <me> <channel> <nick or nick!user@host> <unix time>
+		setBy := strings.SplitN(parsed.Param(2), "!", 2)[0]
+		var setAt time.Time
+		if sec, err := strconv.ParseInt(parsed.Param(3), 10, 64); err == nil {
+			setAt = time.Unix(sec, 0)
+		}
+		chanState.setTopicWho(parsed.Param(1), setBy, setAt)
+	}
+	return nil
+}
+
+// serveChannels renders the state of all channels (or only of ?channel=) as
+// JSON.
+func serveChannels(w http.ResponseWriter, r *http.Request) {
+	infos := chanState.Info()
+	if channel := r.FormValue("channel"); channel != "" {
+		var filtered []ChannelInfo
+		for _, info := range infos {
+			if equalFold(info.Name, channel) {
+				filtered = append(filtered, info)
+			}
+		}
+		infos = filtered
+	}
+	if infos == nil {
+		infos = []ChannelInfo{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(infos); err != nil {
+		channelsLog.Warn("could not write /debug/channels", "err", err)
+	}
+}
+
+func IsMember(nick, channel string) bool {
+	return chanState.IsMember(nick, channel)
+}
+
+// IsOp reports whether nick is an operator in channel.
+func IsOp(nick, channel string) bool {
+	return chanState.IsOp(nick, channel)
+}
+
+// Members returns the nicks in channel.
+func Members(channel string) []string {
+	return chanState.Members(channel)
+}
+
+// ChannelsOf returns the channels in which nick is a member.
+func ChannelsOf(nick string) []string {
+	return chanState.channelsOf(nick)
+}
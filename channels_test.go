@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChannelTracking(t *testing.T) {
+	c := defaultConfig()
+	c.Nick = "frank"
+	withConfig(t, c)
+	resetNick()
+
+	withOutbound(t, 10)
+
+	oldState := chanState
+	defer func() { chanState = oldState }()
+	chanState = newChannelTracker()
+
+	feed := func(lines ...string) {
+		t.Helper()
+		for _, line := range lines {
+			if err := runnerMembers(nil, parseMessage(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	members := func(channel string, want ...string) {
+		t.Helper()
+		if got := Members(channel); !reflect.DeepEqual(got, want) {
+			t.Errorf("Members(%s) = %q, want %q", channel, got, want)
+		}
+	}
+
+	feed(":frank!f@bot JOIN #test")
+	if line, _ := outbound.peek(); line != "MODE #test" {
+		t.Errorf("sent %q after joining, want MODE #test", line)
+	}
+	if chanState.Info()[0].Synced {
+		t.Errorf("#test synced before RPL_ENDOFNAMES")
+	}
+	feed(
+		":irc.example.net 353 frank = #test :frank @alice +bob",
+		":irc.example.net 353 frank = #test :@+carol",
+		":irc.example.net 366 frank #test :End of /NAMES list.",
+		":irc.example.net 324 frank #test +ntk secret",
+		":irc.example.net 332 frank #test :Welcome!",
+		":irc.example.net 333 frank #test alice!a@example.net 1500000000",
+	)
+	members("#test", "alice", "bob", "carol", "frank")
+	for nick, want := range map[string]bool{"alice": true, "bob": false, "carol": true, "frank": false, "dave": false} {
+		if got := IsOp(nick, "#test"); got != want {
+			t.Errorf("IsOp(%s) = %v, want %v", nick, got, want)
+		}
+	}
+	want := ChannelInfo{
+		Name:       "#test",
+		Synced:     true,
+		Modes:      "+knt",
+		Topic:      "Welcome!",
+		TopicSetBy: "alice",
+		TopicSetAt: time.Unix(1500000000, 0),
+		Members:    map[string]string{"frank": "", "alice": "o", "bob": "v", "carol": "ov"},
+	}
+	if got := chanState.Info(); len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+		t.Errorf("Info() = %+v, want %+v", got, want)
+	}
+
+	// modes with and without parameters in one change
+	feed(":alice!a@example.net MODE #test +o-v+l-k bob bob 10 secret")
+	if !IsOp("bob", "#test") || chanState.Info()[0].Members["bob"] != "o" {
+		t.Errorf("MODE +o-v not applied: %+v", chanState.Info()[0])
+	}
+	if got := chanState.Info()[0].Modes; got != "+lnt" {
+		t.Errorf("channel modes = %q, want +lnt", got)
+	}
+	feed(":alice!a@example.net MODE #test -o+b bob *!*@spam")
+	if IsOp("bob", "#test") {
+		t.Errorf("bob still op after MODE -o")
+	}
+
+	feed(":bob!b@example.net TOPIC #test :new topic")
+	if info := chanState.Info()[0]; info.Topic != "new topic" || info.TopicSetBy != "bob" {
+		t.Errorf("topic = %q by %q, want new topic by bob", info.Topic, info.TopicSetBy)
+	}
+
+	feed(
+		":frank!f@bot JOIN #other",
+		":irc.example.net 353 frank = #other :frank carol",
+		":irc.example.net 366 frank #other :End of /NAMES list.",
+		":carol!c@example.net NICK :Carol2",
+	)
+	if got, want := ChannelsOf("carol2"), []string{"#other", "#test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ChannelsOf(carol2) = %q, want %q", got, want)
+	}
+	if !IsOp("Carol2", "#test") {
+		t.Errorf("modes lost when changing nicks")
+	}
+
+	feed(":alice!a@example.net KICK #test bob :bye")
+	members("#test", "Carol2", "alice", "frank")
+
+	feed(":Carol2!c@example.net QUIT :gone")
+	members("#other", "frank")
+
+	// a resync drops members we missed leaving
+	feed(
+		":irc.example.net 353 frank = #test :frank @alice",
+		":irc.example.net 366 frank #test :End of /NAMES list.",
+	)
+	members("#test", "alice", "frank")
+
+	// NAMES for channels we are not in are not tracked
+	feed(
+		":irc.example.net 353 frank = #elsewhere :someone",
+		":irc.example.net 366 frank #elsewhere :End of /NAMES list.",
+	)
+	members("#elsewhere")
+
+	feed(":alice!a@example.net KICK #test frank :out")
+	members("#test")
+	feed(":frank!f@bot PART #other")
+	if got := ChannelsOf("frank"); len(got) != 0 {
+		t.Errorf("ChannelsOf(frank) = %q after leaving all channels", got)
+	}
+}
+
+func TestChannelEvents(t *testing.T) {
+	oldState := chanState
+	defer func() { chanState = oldState }()
+	chanState = newChannelTracker()
+
+	buf, restore := captureLog()
+	defer restore()
+
+	for _, line := range []string{
+		":alice!a@example.net JOIN #test",
+		":bob!b@example.net JOIN #test",
+		":alice!a@example.net KICK #test bob :too loud",
+		":alice!a@example.net NICK :alice2",
+	} {
+		runnerMembers(nil, parseMessage(line))
+	}
+	want := `time=2020-01-02T03:04:05.000Z level=info module=channels msg=join channel=#test nick=alice
+time=2020-01-02T03:04:05.000Z level=info module=channels msg=join channel=#test nick=bob
+time=2020-01-02T03:04:05.000Z level=info module=channels msg=kick channel=#test nick=bob by=alice reason="too loud"
+time=2020-01-02T03:04:05.000Z level=info module=channels msg=nick channel=#test nick=alice new=alice2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("logged:\n%s\nwant:\n%s", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	serveChannels(rec, httptest.NewRequest("GET", "/debug/channels?channel=%23TEST", nil))
+	var infos []ChannelInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || !reflect.DeepEqual(infos[0].Members, map[string]string{"alice2": ""}) {
+		t.Errorf("/debug/channels = %s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	serveChannels(rec, httptest.NewRequest("GET", "/debug/channels?channel=%23other", nil))
+	if got := strings.TrimSpace(rec.Body.String()); got != "[]" {
+		t.Errorf("/debug/channels for an unknown channel = %s, want []", got)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+var commandsLog = newLogger("commands")
+
+// Command is something users can ask frank to do. In channels, commands are
+// invoked as “!name args” or “frank: name args”, in queries the prefix is
+// optional (“name args”).
+type Command struct {
+	// Module groups related commands in the help, see ModuleAdd.
+	Module  string
+	Name    string
+	Aliases []string
+	// Usage describes the arguments, e.g. “<channel> <text>”.
+	Usage string
+	// Help is a short description of what the command does.
+	Help string
+	// Examples are shown in the detailed help, e.g. “karma for frank”.
+	Examples []string
+
+	// MinArgs is the number of required arguments. If MaxArgs is positive,
+	// any further arguments are passed as part of the last one. Otherwise,
+	// the number of arguments is not limited.
+	MinArgs int
+	MaxArgs int
+
+	// Where the command can be used.
+	Channel bool
+	Query   bool
+	// NoPrefix allows using the command in channels without “!” or
+	// addressing frank, also on behalf of others (“alice: name args”).
+	NoPrefix bool
+	// Role restricts the command to admins with at least this role. Other
+	// users are ignored.
+	Role Role
+	// RoleAware commands everybody may use, but which behave differently
+	// depending on Invocation.Role, e.g. help.
+	RoleAware bool
+	// RateLimit limits how often every user may use the command in each
+	// channel. Admins are exempt. Commands may share a rateLimiter.
+	RateLimit *rateLimiter
+
+	Run func(*Invocation) error
+}
+
+// Invocation describes a single use of a command.
+type Invocation struct {
+	Msg  *Message
+	Cmd  *Command
+	Nick string
+	// Channel the command was used in, empty for queries.
+	Channel string
+	Args    []string
+	// Role of the user, only determined for commands which require a role
+	// or are RoleAware, and once the user reached the rate limit.
+	Role Role
+	// Ctx is cancelled when the commands listener times out.
+	Ctx context.Context
+}
+
+// Reply answers in the channel the command was used in, or in the query.
+func (inv *Invocation) Reply(msg string) {
+	if inv.Channel != "" {
+		Privmsg(inv.Channel, msg)
+	} else {
+		Privmsg(inv.Nick, msg)
+	}
+}
+
+// ReplyPrivately always answers in a query.
+func (inv *Invocation) ReplyPrivately(msg string) {
+	Privmsg(inv.Nick, msg)
+}
+
+// Module describes a feature of the bot in the help. Commands belong to
+// a module, but modules like urifind also work without any command.
+type Module struct {
+	Name        string
+	Description string
+	// AdminOnly hides the module from users who are not admins.
+	AdminOnly bool
+}
+
+var modules = struct {
+	mtx  sync.RWMutex
+	list []*Module
+}{}
+
+func ModuleAdd(m *Module) {
+	modules.mtx.Lock()
+	defer modules.mtx.Unlock()
+	for _, existing := range modules.list {
+		if existing.Name == m.Name {
+			commandsLog.Error("module added twice, ignoring the second one", "module", m.Name)
+			return
+		}
+	}
+	modules.list = append(modules.list, m)
+}
+
+func allModules() []*Module {
+	modules.mtx.RLock()
+	defer modules.mtx.RUnlock()
+	return append([]*Module(nil), modules.list...)
+}
+
+// moduleCommands returns the commands belonging to module, in the order they
+// were added.
+func moduleCommands(module string) []*Command {
+	commands.mtx.RLock()
+	defer commands.mtx.RUnlock()
+	var result []*Command
+	for _, c := range commands.list {
+		if c.Module == module {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+var commands = struct {
+	mtx    sync.RWMutex
+	list   []*Command
+	byName map[string]*Command
+}{byName: make(map[string]*Command)}
+
+func CommandAdd(c *Command) {
+	commands.mtx.Lock()
+	defer commands.mtx.Unlock()
+	commandsLog.Debug("adding command", "command", c.Name)
+	names := append([]string{c.Name}, c.Aliases...)
+	for _, name := range names {
+		if _, ok := commands.byName[strings.ToLower(name)]; ok {
+			commandsLog.Error("command name used twice, ignoring the command", "name", name, "command", c.Name)
+			return
+		}
+	}
+	commands.list = append(commands.list, c)
+	for _, name := range names {
+		commands.byName[strings.ToLower(name)] = c
+	}
+}
+
+func commandByName(name string) *Command {
+	commands.mtx.RLock()
+	defer commands.mtx.RUnlock()
+	return commands.byName[strings.ToLower(name)]
+}
+
+// parseCommand extracts the command name and its arguments from a message.
+// prefixed reports whether the command was explicitly addressed to the bot.
+func parseCommand(text string, botnick string) (name, args string, prefixed bool) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "!") {
+		text = text[1:]
+		prefixed = true
+	} else if len(text) > len(botnick) &&
+		strings.EqualFold(text[:len(botnick)], botnick) &&
+		strings.ContainsRune(":,", rune(text[len(botnick)])) {
+		text = strings.TrimSpace(text[len(botnick)+1:])
+		prefixed = true
+	}
+
+	fields := strings.SplitN(text, " ", 2)
+	name = fields[0]
+	if len(fields) > 1 {
+		args = strings.TrimSpace(fields[1])
+	}
+	return name, args, prefixed
+}
+
+// addresseeRegex matches the nick a message starts with, e.g. “alice:”.
+var addresseeRegex = regexp.MustCompile(`^[\d\pL._-]+:$`)
+
+// splitArgs splits args at whitespace into at most max fields (unlimited if
+// max is not positive). The last field contains the remainder.
+func splitArgs(args string, max int) []string {
+	var result []string
+	for args != "" {
+		if max > 0 && len(result) == max-1 {
+			result = append(result, args)
+			break
+		}
+		fields := strings.SplitN(args, " ", 2)
+		result = append(result, fields[0])
+		args = ""
+		if len(fields) > 1 {
+			args = strings.TrimSpace(fields[1])
+		}
+	}
+	return result
+}
+
+// runnerCommands dispatches messages to the registered commands.
+func runnerCommands(ctx context.Context, parsed *Message) error {
+	if parsed.Command != irc.PRIVMSG {
+		return nil
+	}
+
+	query := IsPrivateQuery(parsed)
+	name, args, prefixed := parseCommand(parsed.Trailing(), currentNick())
+	cmd := commandByName(name)
+	if cmd == nil && !prefixed && addresseeRegex.MatchString(name) {
+		// “alice: lmgtfy foo” uses a NoPrefix command on behalf of alice
+		name, args, prefixed = parseCommand(args, currentNick())
+		cmd = commandByName(name)
+	}
+	if cmd == nil {
+		return nil
+	}
+
+	if query && !cmd.Query {
+		return nil
+	}
+	if !query && (!cmd.Channel || (!prefixed && !cmd.NoPrefix)) {
+		return nil
+	}
+	if !query && !moduleEnabled(cmd.Module, Target(parsed)) {
+		return nil
+	}
+
+	inv := &Invocation{
+		Ctx:  ctx,
+		Msg:  parsed,
+		Cmd:  cmd,
+		Nick: Nick(parsed),
+		Args: splitArgs(args, cmd.MaxArgs),
+	}
+	if !query {
+		inv.Channel = Target(parsed)
+	}
+
+	// admins are exempt from rate limits, so their role matters once the
+	// limit is reached
+	limited := cmd.RateLimit != nil && cmd.RateLimit.limited(inv.Nick, inv.Channel)
+	if cmd.Role == RoleNone && !cmd.RoleAware && !limited {
+		return runInvocation(inv)
+	}
+	role, ok := userRole(parsed, func(role Role) {
+		// The account lookup finished after we returned.
+		inv.Role = role
+		go runDeferred(inv)
+	})
+	if !ok {
+		return nil
+	}
+	inv.Role = role
+	return runInvocation(inv)
+}
+
+// runInvocation runs the command if the user is allowed to.
+func runInvocation(inv *Invocation) error {
+	cmd := inv.Cmd
+	if inv.Role < cmd.Role {
+		return nil
+	}
+	if len(inv.Args) < cmd.MinArgs {
+		inv.Reply("Usage: " + strings.TrimSpace(cmd.Name+" "+cmd.Usage))
+		return nil
+	}
+	if cmd.RateLimit != nil {
+		ok, warn, wait := cmd.RateLimit.allow(inv.Nick, inv.Channel, inv.Role)
+		if !ok {
+			commandsLog.Info("rate limited", "nick", inv.Nick, "command", cmd.Name, "channel", inv.Channel)
+			if warn {
+				inv.ReplyPrivately(slowDownNotice(cmd.RateLimit.name, wait))
+			}
+			return nil
+		}
+	}
+	if cmd.Role > RoleNone {
+		audit(inv.Msg, cmd.Name, inv.Args...)
+	}
+	return cmd.Run(inv)
+}
+
+// how long commands may take which run after looking up the user’s account
+const deferredCommandTimeout = 30 * time.Second
+
+// runDeferred runs inv outside of the listeners, but just as protected
+// against slow or panicking commands.
+func runDeferred(inv *Invocation) {
+	ctx, cancel := context.WithTimeout(context.Background(), deferredCommandTimeout)
+	defer cancel()
+	inv.Ctx = ctx
+	defer func() {
+		if r := recover(); r != nil {
+			commandsLog.Error("command panicked", "command", inv.Cmd.Name, "line", redactLine(inv.Msg.String()), "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	if err := runInvocation(inv); err != nil {
+		commandsLog.Warn("command failed", "command", inv.Cmd.Name, "err", err)
+	}
+}
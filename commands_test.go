@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// withCommands removes the commands registered by the test when it ends.
+func withCommands(t *testing.T) {
+	commands.mtx.Lock()
+	defer commands.mtx.Unlock()
+	list, byName := commands.list, commands.byName
+	t.Cleanup(func() {
+		commands.mtx.Lock()
+		defer commands.mtx.Unlock()
+		commands.list, commands.byName = list, byName
+	})
+	commands.list = append([]*Command(nil), list...)
+	commands.byName = make(map[string]*Command)
+	for name, c := range byName {
+		commands.byName[name] = c
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tcs := []struct {
+		Text     string
+		Name     string
+		Args     string
+		Prefixed bool
+	}{
+		{"help", "help", "", false},
+		{"!help", "help", "", true},
+		{"!karma for  frank?", "karma", "for  frank?", true},
+		{"frank: man 1 ls", "man", "1 ls", true},
+		{"Frank, man ls", "man", "ls", true},
+		{"frankly: man ls", "frankly:", "man ls", false},
+		{"karma thing", "karma", "thing", false},
+		{"", "", "", false},
+	}
+
+	for _, tc := range tcs {
+		name, args, prefixed := parseCommand(tc.Text, "frank")
+		if name != tc.Name || args != tc.Args || prefixed != tc.Prefixed {
+			t.Errorf("parseCommand(%q) = %q, %q, %v, want %q, %q, %v", tc.Text, name, args, prefixed, tc.Name, tc.Args, tc.Prefixed)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tcs := []struct {
+		Args string
+		Max  int
+		Want []string
+	}{
+		{"", 0, nil},
+		{"a b  c", 0, []string{"a", "b", "c"}},
+		{"#chan hello  world", 2, []string{"#chan", "hello  world"}},
+		{"only", 2, []string{"only"}},
+		{"custom text", 1, []string{"custom text"}},
+	}
+
+	for _, tc := range tcs {
+		if got := splitArgs(tc.Args, tc.Max); !reflect.DeepEqual(got, tc.Want) {
+			t.Errorf("splitArgs(%q, %d) = %q, want %q", tc.Args, tc.Max, got, tc.Want)
+		}
+	}
+}
+
+// invocations of the testcmd command
+var testInvocations []*Invocation
+
+func TestRunnerCommands(t *testing.T) {
+	testInvocations = nil
+	withCommands(t)
+	CommandAdd(&Command{
+		Name:    "testcmd",
+		Aliases: []string{"tc"},
+		MinArgs: 1,
+		MaxArgs: 2,
+		Channel: true,
+		Query:   true,
+		Run: func(inv *Invocation) error {
+			testInvocations = append(testInvocations, inv)
+			return nil
+		},
+	})
+
+	for _, raw := range []string{
+		":alice!a@host PRIVMSG #chan :!testcmd one two three",
+		":alice!a@host PRIVMSG #chan :frank: TC one",
+		":alice!a@host PRIVMSG frank :testcmd one",
+		// not addressed to us
+		":alice!a@host PRIVMSG #chan :testcmd one",
+		// missing argument, replies with usage
+		":alice!a@host PRIVMSG frank :testcmd",
+		// addressed to someone else, and testcmd is not NoPrefix
+		":alice!a@host PRIVMSG #chan :bob: testcmd one",
+	} {
+		if err := runnerCommands(context.Background(), parseMessage(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := testInvocations
+	if len(got) != 3 {
+		t.Fatalf("command ran %d times, want 3", len(got))
+	}
+	if want := []string{"one", "two three"}; !reflect.DeepEqual(got[0].Args, want) {
+		t.Errorf("Args = %q, want %q", got[0].Args, want)
+	}
+	if got[0].Channel != "#chan" || got[1].Channel != "#chan" || got[2].Channel != "" {
+		t.Errorf("unexpected channels: %q, %q, %q", got[0].Channel, got[1].Channel, got[2].Channel)
+	}
+	if got[2].Nick != "alice" {
+		t.Errorf("Nick = %q, want alice", got[2].Nick)
+	}
+}
+
+func TestRunnerCommandsNoPrefix(t *testing.T) {
+	testInvocations = nil
+	withCommands(t)
+	CommandAdd(&Command{
+		Name:     "testnp",
+		Aliases:  []string{"testnp:"},
+		MinArgs:  1,
+		Channel:  true,
+		NoPrefix: true,
+		Run: func(inv *Invocation) error {
+			testInvocations = append(testInvocations, inv)
+			return nil
+		},
+	})
+
+	for _, raw := range []string{
+		":alice!a@host PRIVMSG #chan :testnp one",
+		":alice!a@host PRIVMSG #chan :testnp: two",
+		":alice!a@host PRIVMSG #chan :bob: testnp three",
+		":alice!a@host PRIVMSG #chan :!testnp four",
+		// not a nick
+		":alice!a@host PRIVMSG #chan :well, testnp five",
+	} {
+		if err := runnerCommands(context.Background(), parseMessage(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var args []string
+	for _, inv := range testInvocations {
+		args = append(args, inv.Args...)
+	}
+	if want := []string{"one", "two", "three", "four"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("ran with %q, want %q", args, want)
+	}
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config describes everything about the bot that used to be hard coded. It is
+// read from the JSON file given by -config; flags that are explicitly set on
+// the command line override the corresponding values from the file.
+type Config struct {
+	// Transport is either "robustirc" (the default) or "irc".
+	Transport string `json:"transport"`
+	// Network is the RobustIRC network to connect to (transport robustirc).
+	Network string `json:"network"`
+	// Server is the host:port of the IRC server to connect to (transport
+	// irc), TLS enables TLS for that connection.
+	Server    string `json:"server"`
+	TLS       bool   `json:"tls"`
+	TLSCAFile string `json:"tls_ca_file"`
+	// TLSClientCert and TLSClientKey are PEM files with a client
+	// certificate to present (transport irc), e.g. for SASL EXTERNAL.
+	TLSClientCert    string     `json:"tls_client_cert"`
+	TLSClientKey     string     `json:"tls_client_key"`
+	SASL             SASLConfig `json:"sasl"`
+	ListenHTTP       string     `json:"listen_http"`
+	Nick             string     `json:"nick"`
+	NickservPassword string     `json:"nickserv_password"`
+	Channels         []string   `json:"channels"`
+	// Verbose makes debug the default log level.
+	Verbose bool      `json:"verbose"`
+	Log     LogConfig `json:"log"`
+	// Admins may control the bot, depending on their role.
+	Admins []AdminConfig `json:"admins"`
+	// StateFile is the database in which karma, last-seen times and caches
+	// are kept. If empty, they are lost on restart.
+	StateFile string `json:"state_file"`
+
+	Flood FloodConfig `json:"flood"`
+	// MaxLines limits how many lines a single message may be split into.
+	// Zero means no limit.
+	MaxLines int `json:"max_lines"`
+
+	// ChannelSettings enables, disables and configures modules per channel.
+	ChannelSettings map[string]ChannelConfig `json:"channel_settings"`
+
+	Greeter      GreeterConfig      `json:"greeter"`
+	Raumbang     RaumbangConfig     `json:"raumbang"`
+	RSS          RSSConfig          `json:"rss"`
+	TopicChanger TopicChangerConfig `json:"topic_changer"`
+	Urifind      UrifindConfig      `json:"urifind"`
+}
+
+// SASLConfig configures SASL authentication during registration, which
+// only the irc transport supports. Mechanism is "plain", "external" (using
+// the TLS client certificate) or empty to not use SASL. For plain, Account
+// defaults to the nick and Password to nickserv_password.
+type SASLConfig struct {
+	Mechanism string `json:"mechanism"`
+	Account   string `json:"account"`
+	Password  string `json:"password"`
+}
+
+// LogConfig configures the log output. Format is "logfmt" (the default) or
+// "json". Levels maps module names, or "default" for all others, to the
+// lowest level which is logged: "debug", "info", "warn" or "error".
+type LogConfig struct {
+	Format string            `json:"format"`
+	Levels map[string]string `json:"levels"`
+}
+
+// FloodConfig configures the token bucket limiting how fast frank sends
+// lines: Burst lines can be sent at once, after that one line per Interval.
+type FloodConfig struct {
+	Burst    int      `json:"burst"`
+	Interval Duration `json:"interval"`
+}
+
+type GreeterConfig struct {
+	// Channels in which new users are greeted, unless channel_settings
+	// say otherwise.
+	Channels []string `json:"channels"`
+	// Template is the path to a text/template file used to render the
+	// greeting. A generic greeting is used if it cannot be parsed. It can
+	// be overridden per channel with the “template” setting, which contains
+	// the template itself instead of a path.
+	Template string `json:"template"`
+}
+
+type RaumbangConfig struct {
+	HostToPing string `json:"host_to_ping"`
+}
+
+type RSSConfig struct {
+	Feeds []FeedConfig `json:"feeds"`
+}
+
+type FeedConfig struct {
+	Channel string `json:"channel"`
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+}
+
+type TopicChangerConfig struct {
+	// Channels whose topic is kept up to date with the next event, unless
+	// channel_settings say otherwise.
+	Channels []string `json:"channels"`
+	// DSN is the Postgres connection string for the event database.
+	DSN string `json:"dsn"`
+}
+
+type UrifindConfig struct {
+	PointlessTitles []string `json:"pointless_titles"`
+	// IgnoreDomains is a regular expression matched against every URL.
+	// Matching URLs are never resolved.
+	IgnoreDomains string `json:"ignore_domains"`
+	// MetricsDomains get their own label in the title fetch metrics,
+	// including their subdomains. Every label is a separate time series, so
+	// links to all other domains share the label “other”.
+	MetricsDomains []string `json:"metrics_domains"`
+
+	ignoreDomainsRegex *regexp.Regexp
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Nick:   "frank",
+		Admins: []AdminConfig{{Account: "xeen", Role: RoleOwner}},
+		Flood: FloodConfig{
+			Burst:    5,
+			Interval: Duration{2 * time.Second},
+		},
+		MaxLines:  3,
+		StateFile: "frank.db",
+		Greeter: GreeterConfig{
+			Channels: []string{"#chaos-hd"},
+			Template: "greeting.txt",
+		},
+		Raumbang: RaumbangConfig{
+			HostToPing: "chaostreff.vpn.zekjur.net",
+		},
+		RSS: RSSConfig{
+			Feeds: []FeedConfig{
+				{"#chaos-hd", "nn-web", "https://www.noname-ev.de/gitcommits.atom"},
+				{"#chaos-hd", "nn-wiki", "https://www.noname-ev.de/wiki/index.php?title=Special:RecentChanges&feed=atom"},
+				{"#chaos-hd", "nn-planet", "http://blogs.noname-ev.de/atom.xml"},
+				{"#chaos-hd", "frank", "https://github.com/nnev/frank/commits/robust.atom"},
+			},
+		},
+		TopicChanger: TopicChangerConfig{
+			Channels: []string{"#chaos-hd"},
+			DSN:      "dbname=nnev user=anon host=/var/run/postgresql sslmode=disable",
+		},
+		Urifind: UrifindConfig{
+			PointlessTitles: []string{"",
+				"imgur: the simple image sharer",
+				"Fefes Blog",
+				"Gmane Loom",
+				"i3 - A better tiling and dynamic window manager",
+				"i3 - improved tiling wm",
+				"IT-News, c't, iX, Technology Review, Telepolis | heise online",
+				"debian Pastezone",
+				"Index of /docs/",
+				"NoName e.V. pastebin",
+				"Nopaste - powered by project-mindstorm IT Services",
+				"Diff NoName e.V. pastebin",
+				"pr0gramm.com",
+				"Google"},
+			IgnoreDomains: `^http://p\.nnev\.de`,
+			MetricsDomains: []string{
+				"ccc.de",
+				"github.com",
+				"gitlab.com",
+				"golem.de",
+				"heise.de",
+				"noname-ev.de",
+				"reddit.com",
+				"spiegel.de",
+				"twitter.com",
+				"wikipedia.org",
+				"youtu.be",
+				"youtube.com",
+				"zeit.de",
+			},
+		},
+	}
+}
+
+var config = struct {
+	mtx sync.RWMutex
+	c   *Config
+}{c: mustValidate(defaultConfig())}
+
+// currentConfig returns the active configuration. The returned value must be
+// treated as read-only.
+func currentConfig() *Config {
+	config.mtx.RLock()
+	defer config.mtx.RUnlock()
+	return config.c
+}
+
+func setConfig(c *Config) {
+	config.mtx.Lock()
+	defer config.mtx.Unlock()
+	config.c = c
+}
+
+func mustValidate(c *Config) *Config {
+	if err := c.validate(); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// loadConfig reads the configuration file at path (if non-empty), applies all
+// explicitly set command line flags on top and validates the result.
+func loadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", path, err)
+		}
+	}
+
+	c.applyFlags()
+
+	if err := c.validate(); err != nil {
+		if path == "" {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// applyFlags overrides config values with the flags that were set explicitly
+// on the command line.
+func (c *Config) applyFlags() {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "network":
+			c.Network = *network
+		case "tls_ca_file":
+			c.TLSCAFile = *tlsCAFile
+		case "listen_http":
+			c.ListenHTTP = *listenHttp
+		case "channels":
+			c.Channels = strings.Fields(*channels)
+		case "nick":
+			c.Nick = *nick
+		case "admins":
+			c.Admins = nil
+			for _, account := range strings.Fields(*admins) {
+				c.Admins = append(c.Admins, AdminConfig{Account: account, Role: RoleOwner})
+			}
+		case "nickserv_password":
+			c.NickservPassword = *nickserv_password
+		case "verbose":
+			c.Verbose = *verbose
+		}
+	})
+}
+
+// validate checks the config for errors and normalizes channel names.
+// The network is not checked here, it is only required when actually
+// connecting (see setupFlags).
+func (c *Config) validate() error {
+	switch c.Transport {
+	case "", "robustirc":
+	case "irc":
+		if c.Server != "" {
+			if _, _, err := net.SplitHostPort(c.Server); err != nil {
+				return fmt.Errorf("server: %v", err)
+			}
+		}
+	default:
+		return fmt.Errorf("transport must be \"robustirc\" or \"irc\", not %q", c.Transport)
+	}
+	if (c.TLSClientCert == "") != (c.TLSClientKey == "") {
+		return errors.New("tls_client_cert and tls_client_key must be set together")
+	}
+	if c.TLSClientCert != "" && (c.Transport != "irc" || !c.TLS) {
+		return errors.New("tls_client_cert requires the irc transport with tls")
+	}
+	switch c.SASL.Mechanism {
+	case "":
+	case "plain", "external":
+		if c.Transport != "irc" {
+			return errors.New("sasl requires the irc transport")
+		}
+		if c.SASL.Mechanism == "external" && c.TLSClientCert == "" {
+			return errors.New("sasl mechanism external requires tls_client_cert")
+		}
+	default:
+		return fmt.Errorf("sasl.mechanism must be \"plain\" or \"external\", not %q", c.SASL.Mechanism)
+	}
+
+	if err := validateLogConfig(c.Log); err != nil {
+		return err
+	}
+
+	if c.Nick == "" {
+		return errors.New("nick must not be empty")
+	}
+	if strings.ContainsAny(c.Nick, " ,*?!@#:") {
+		return fmt.Errorf("nick %q contains invalid characters", c.Nick)
+	}
+
+	for i, a := range c.Admins {
+		if err := a.validate(); err != nil {
+			return fmt.Errorf("admins[%d]: %v", i, err)
+		}
+	}
+
+	if c.Flood.Burst < 1 {
+		return errors.New("flood.burst must be at least 1")
+	}
+	if c.Flood.Interval.Duration <= 0 {
+		return errors.New("flood.interval must be positive")
+	}
+
+	if c.MaxLines < 0 {
+		return errors.New("max_lines must not be negative")
+	}
+
+	var err error
+	if c.Channels, err = normalizeChannels("channels", c.Channels); err != nil {
+		return err
+	}
+	if c.Greeter.Channels, err = normalizeChannels("greeter.channels", c.Greeter.Channels); err != nil {
+		return err
+	}
+	if c.TopicChanger.Channels, err = normalizeChannels("topic_changer.channels", c.TopicChanger.Channels); err != nil {
+		return err
+	}
+
+	if err := c.validateChannelSettings(); err != nil {
+		return err
+	}
+
+	topicChanger := len(c.TopicChanger.Channels) > 0
+	for _, cc := range c.ChannelSettings {
+		topicChanger = topicChanger || cc.Modules["topicchanger"]
+	}
+	if topicChanger && c.TopicChanger.DSN == "" {
+		return errors.New("topic_changer.dsn must be set when the topic changer is enabled in any channel")
+	}
+
+	names := make(map[string]bool)
+	for idx, f := range c.RSS.Feeds {
+		if f.Name == "" {
+			return fmt.Errorf("rss.feeds[%d]: name must not be empty", idx)
+		}
+		if names[f.Name] {
+			return fmt.Errorf("rss.feeds[%d]: duplicate feed name %q", idx, f.Name)
+		}
+		names[f.Name] = true
+		if !strings.HasPrefix(f.URL, "http://") && !strings.HasPrefix(f.URL, "https://") {
+			return fmt.Errorf("rss.feeds[%d] (%s): url %q must be an http or https URL", idx, f.Name, f.URL)
+		}
+		ch, err := normalizeChannel(f.Channel)
+		if err != nil {
+			return fmt.Errorf("rss.feeds[%d] (%s): %v", idx, f.Name, err)
+		}
+		c.RSS.Feeds[idx].Channel = ch
+	}
+
+	re, err := regexp.Compile(c.Urifind.IgnoreDomains)
+	if err != nil {
+		return fmt.Errorf("urifind.ignore_domains: %v", err)
+	}
+	if c.Urifind.IgnoreDomains == "" {
+		re = nil
+	}
+	c.Urifind.ignoreDomainsRegex = re
+
+	for i, domain := range c.Urifind.MetricsDomains {
+		if domain == "" || strings.ContainsAny(domain, "/: ") {
+			return fmt.Errorf("urifind.metrics_domains[%d]: %q is not a domain", i, domain)
+		}
+		c.Urifind.MetricsDomains[i] = strings.ToLower(domain)
+	}
+
+	return nil
+}
+
+// Duration is a time.Duration which is written as a string like "1m30s" in
+// the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1m30s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func normalizeChannel(channel string) (string, error) {
+	channel = strings.TrimSpace(channel)
+	if channel == "" {
+		return "", errors.New("channel name must not be empty")
+	}
+	if strings.ContainsAny(channel, " ,\a") {
+		return "", fmt.Errorf("channel name %q contains invalid characters", channel)
+	}
+	if !strings.HasPrefix(channel, "#") {
+		channel = "#" + channel
+	}
+	return channel, nil
+}
+
+func normalizeChannels(field string, channels []string) ([]string, error) {
+	var result []string
+	for _, channel := range channels {
+		normalized, err := normalizeChannel(channel)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", field, err)
+		}
+		result = append(result, normalized)
+	}
+	return result, nil
+}
+
+// reloadMtx serializes reloads.
+var reloadMtx sync.Mutex
+
+// reloadConfig re-reads the config file, applies the new configuration
+// without dropping the connection and returns a human readable list of what
+// changed.
+func reloadConfig() ([]string, error) {
+	// a SIGHUP and the reload command must not both apply the same change
+	reloadMtx.Lock()
+	defer reloadMtx.Unlock()
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	old := currentConfig()
+	setConfig(c)
+
+	for _, channel := range c.Channels {
+		if !IsIn(channel, old.Channels) {
+			Join(channel)
+		}
+	}
+	for _, channel := range old.Channels {
+		if !IsIn(channel, c.Channels) {
+			Part(channel)
+		}
+	}
+	if c.Nick != old.Nick {
+		setWantedNick(c.Nick)
+	}
+	if !reflect.DeepEqual(c.RSS, old.RSS) {
+		Rss()
+	}
+	readGreeting()
+	applyLogConfig(c)
+
+	return configChanges(old, c), nil
+}
+
+// configChanges describes the differences between two configurations.
+func configChanges(old, c *Config) []string {
+	var changes []string
+	listChange := func(what string, old, new []string) {
+		var added, removed []string
+		for _, s := range new {
+			if !IsIn(s, old) {
+				added = append(added, s)
+			}
+		}
+		for _, s := range old {
+			if !IsIn(s, new) {
+				removed = append(removed, s)
+			}
+		}
+		if len(added) > 0 {
+			changes = append(changes, fmt.Sprintf("%s added: %s", what, strings.Join(added, " ")))
+		}
+		if len(removed) > 0 {
+			changes = append(changes, fmt.Sprintf("%s removed: %s", what, strings.Join(removed, " ")))
+		}
+	}
+
+	if c.Transport != old.Transport || c.Network != old.Network || c.Server != old.Server || c.TLS != old.TLS || c.TLSCAFile != old.TLSCAFile ||
+		c.TLSClientCert != old.TLSClientCert || c.TLSClientKey != old.TLSClientKey || c.SASL != old.SASL {
+		changes = append(changes, "network settings changed, they only take effect after a restart")
+	}
+	if c.ListenHTTP != old.ListenHTTP {
+		changes = append(changes, "listen_http changed, it only takes effect after a restart")
+	}
+	if c.StateFile != old.StateFile {
+		changes = append(changes, "state_file changed, it only takes effect after a restart")
+	}
+	if c.Nick != old.Nick {
+		changes = append(changes, fmt.Sprintf("nick changed from %s to %s", old.Nick, c.Nick))
+	}
+	if c.NickservPassword != old.NickservPassword {
+		changes = append(changes, "nickserv_password changed")
+	}
+	if c.Flood != old.Flood {
+		changes = append(changes, "flood settings changed, they only take effect after a restart")
+	}
+	if c.Verbose != old.Verbose {
+		changes = append(changes, fmt.Sprintf("verbose is now %v", c.Verbose))
+	}
+	if !reflect.DeepEqual(c.Log, old.Log) {
+		changes = append(changes, "log settings changed")
+	}
+	listChange("channels", old.Channels, c.Channels)
+	adminStrings := func(admins []AdminConfig) []string {
+		var result []string
+		for _, a := range admins {
+			result = append(result, a.String())
+		}
+		return result
+	}
+	listChange("admins", adminStrings(old.Admins), adminStrings(c.Admins))
+
+	var oldFeeds, newFeeds []string
+	for _, f := range old.RSS.Feeds {
+		oldFeeds = append(oldFeeds, f.Name+"→"+f.Channel+"("+f.URL+")")
+	}
+	for _, f := range c.RSS.Feeds {
+		newFeeds = append(newFeeds, f.Name+"→"+f.Channel+"("+f.URL+")")
+	}
+	listChange("rss feeds", oldFeeds, newFeeds)
+
+	modules := []struct {
+		name     string
+		old, new interface{}
+	}{
+		// compare the settings, not the parsed greeting templates
+		{"channel_settings", settingsSource(old.ChannelSettings), settingsSource(c.ChannelSettings)},
+		{"greeter", old.Greeter, c.Greeter},
+		{"raumbang", old.Raumbang, c.Raumbang},
+		{"topic_changer", old.TopicChanger, c.TopicChanger},
+		// compare the source of the regex, not the compiled one
+		{"urifind",
+			[]interface{}{old.Urifind.PointlessTitles, old.Urifind.IgnoreDomains, old.Urifind.MetricsDomains},
+			[]interface{}{c.Urifind.PointlessTitles, c.Urifind.IgnoreDomains, c.Urifind.MetricsDomains}},
+	}
+	for _, m := range modules {
+		if !reflect.DeepEqual(m.old, m.new) {
+			changes = append(changes, m.name+" settings changed")
+		}
+	}
+
+	if len(changes) == 0 {
+		changes = append(changes, "nothing changed")
+	}
+	return changes
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// withConfig makes c the current config until the test ends.
+func withConfig(t *testing.T, c *Config) {
+	t.Helper()
+	old := currentConfig()
+	t.Cleanup(func() { setConfig(old) })
+	setConfig(c)
+}
+
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"network": "robustirc.net",
+		"nick": "frankie",
+		"channels": ["chaos-hd", "#noname-ev"],
+		"rss": {"feeds": [{"channel": "test", "name": "t", "url": "https://example.com/feed.atom"}]}
+	}`)
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Nick, "frankie"; got != want {
+		t.Errorf("Nick = %q, want %q", got, want)
+	}
+	if got, want := c.Channels, []string{"#chaos-hd", "#noname-ev"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Channels = %q, want %q", got, want)
+	}
+	if got, want := c.RSS.Feeds[0].Channel, "#test"; got != want {
+		t.Errorf("RSS.Feeds[0].Channel = %q, want %q", got, want)
+	}
+	// unset values keep their defaults
+	if got, want := c.Raumbang.HostToPing, defaultConfig().Raumbang.HostToPing; got != want {
+		t.Errorf("Raumbang.HostToPing = %q, want %q", got, want)
+	}
+	if !c.Urifind.ignoreDomainsRegex.MatchString("http://p.nnev.de/123") {
+		t.Errorf("default ignore_domains should match the pastebin")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tcs := []struct {
+		Config string
+		Error  string
+	}{
+		{`{"nick": ""}`, "nick must not be empty"},
+		{`{"nick": "fr ank"}`, "invalid characters"},
+		{`{"nikc": "frank"}`, "unknown field"},
+		{`{"channels": ["#a b"]}`, "channels: channel name"},
+		{`{"urifind": {"ignore_domains": "("}}`, "urifind.ignore_domains"},
+		{`{"urifind": {"metrics_domains": ["https://github.com"]}}`, "urifind.metrics_domains[0]"},
+		{`{"rss": {"feeds": [{"channel": "#a", "name": "a", "url": "ftp://x"}]}}`, "rss.feeds[0] (a)"},
+		{`{"rss": {"feeds": [{"channel": "#a", "name": "a", "url": "http://x"}, {"channel": "#a", "name": "a", "url": "http://y"}]}}`, "duplicate feed name"},
+		{`{"topic_changer": {"dsn": ""}}`, "topic_changer.dsn"},
+		{`{"topic_changer": {"channels": [], "dsn": ""}, "channel_settings": {"#a": {"modules": {"topicchanger": true}}}}`, "topic_changer.dsn"},
+		{`{"channel_settings": {"#a b": {}}}`, "channel_settings: channel name"},
+		{`{"channel_settings": {"#a": {"settings": {"greeter": {"template": "Hi {{ .Nick"}}}}}`, "channel_settings[#a].settings.greeter.template"},
+	}
+
+	for _, tc := range tcs {
+		_, err := loadConfig(writeTestConfig(t, tc.Config))
+		if err == nil {
+			t.Errorf("loadConfig(%s) succeeded unexpectedly", tc.Config)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.Error) {
+			t.Errorf("loadConfig(%s) = %v, want error containing %q", tc.Config, err, tc.Error)
+		}
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	old := defaultConfig()
+	c := defaultConfig()
+	if got, want := configChanges(old, c), []string{"nothing changed"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("configChanges(default, default) = %q, want %q", got, want)
+	}
+
+	c.Channels = []string{"#new"}
+	old.Channels = []string{"#old"}
+	c.Raumbang.HostToPing = "example.com"
+	c.RSS.Feeds = c.RSS.Feeds[1:]
+	want := []string{
+		"channels added: #new",
+		"channels removed: #old",
+		"rss feeds removed: nn-web→#chaos-hd(https://www.noname-ev.de/gitcommits.atom)",
+		"raumbang settings changed",
+	}
+	if got := configChanges(old, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("configChanges() = %q, want %q", got, want)
+	}
+}
@@ -1,23 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
-	"github.com/robustirc/bridge/robustsession"
-	"gopkg.in/sorcix/irc.v2"
-
 	_ "net/http/pprof"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/sorcix/irc.v2"
 )
 
 var (
+	configPath = flag.String("config", "", "path to a JSON config file. Flags that are set explicitly override its values.")
+
 	network   = flag.String("network", "", `DNS name to connect to (e.g. "robustirc.net"). The _robustirc._tcp SRV record must be present.`)
 	tlsCAFile = flag.String("tls_ca_file", "", "Use the specified file as trusted CA instead of the system CAs. Useful for testing.")
 
@@ -25,30 +26,38 @@ var (
 
 	channels          = flag.String("channels", "", "channels the bot should join. Space separated.")
 	nick              = flag.String("nick", "frank", "nickname of the bot")
-	admins            = flag.String("admins", "xeen", "users who can control the bot. Space separated.")
+	admins            = flag.String("admins", "xeen", "NickServ accounts which own the bot. Space separated. On servers which do not report accounts (e.g. RobustIRC), these are the nicks the owners identified for.")
 	nickserv_password = flag.String("nickserv_password", "", "password used to identify with nickserv. No action is taken if password is blank or not set.")
 
 	verbose = flag.Bool("verbose", false, "enable to get very detailed logs")
 )
 
-var session *robustsession.RobustSession
+var bootTimestamp = time.Now()
+
+var mainLog = newLogger("main")
 
 func setupFlags() {
 	flag.Parse()
 
-	if *network == "" {
-		log.Fatal("You must specify -network")
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		mainLog.Fatal("invalid configuration", "err", err)
 	}
+	setConfig(c)
+	setupLogging(c)
 }
 
-func setupSession() {
-	var err error
-	session, err = robustsession.Create(*network, *tlsCAFile)
-	if err != nil {
-		log.Fatalf("Could not create RobustIRC session: %v", err)
+// checkConnectionConfig makes sure we know where to connect to. Subcommands
+// like export work without.
+func checkConnectionConfig() {
+	c := currentConfig()
+	if c.Transport == "irc" {
+		if c.Server == "" {
+			mainLog.Fatal("You must specify server in the config file when using the irc transport")
+		}
+	} else if c.Network == "" {
+		mainLog.Fatal("You must specify -network (or network in the config file)")
 	}
-
-	log.Printf("Created RobustSession for %s. Session id: %s", *nick, session.SessionId())
 }
 
 func setupKeepalive() {
@@ -57,7 +66,9 @@ func setupKeepalive() {
 		keepaliveToNetwork := time.After(1 * time.Minute)
 		for {
 			<-keepaliveToNetwork
-			session.PostMessage("PING keepalive")
+			if t := currentTransport(); t != nil {
+				t.Send("PING keepalive")
+			}
 			keepaliveToNetwork = time.After(1 * time.Minute)
 		}
 	}()
@@ -68,105 +79,166 @@ func setupSignalHandler() {
 	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
 		sig := <-signalChan
-		log.Printf("Exiting due to signal %q", sig)
+		mainLog.Info("exiting due to signal", "signal", sig)
 		kill()
 	}()
-}
 
-func setupSessionErrorHandler() {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 	go func() {
-		err := <-session.Errors
-		log.Fatalf("RobustIRC session error: %v", err)
+		for range hupChan {
+			mainLog.Info("reloading config due to SIGHUP")
+			changes, err := reloadConfig()
+			if err != nil {
+				mainLog.Error("could not reload config, keeping the old one", "err", err)
+				continue
+			}
+			for _, change := range changes {
+				mainLog.Info("config reload", "change", change)
+			}
+		}
 	}()
 }
 
 func setupJoinChannels() {
-	for _, channel := range strings.Split(*channels, " ") {
+	for _, channel := range currentConfig().Channels {
 		Join(channel)
 	}
 }
 
+// runnerJoinChannels joins the configured channels once the server has
+// accepted us, i.e. again after every reconnect. Servers reject JOINs while
+// we are still registering, e.g. before CAP END.
+func runnerJoinChannels(ctx context.Context, parsed *Message) error {
+	if parsed.Command == irc.RPL_WELCOME {
+		setupJoinChannels()
+	}
+	return nil
+}
+
 func kill() {
-	log.Printf("Deleting Session. Goodbye.")
+	mainLog.Info("closing connection, goodbye")
 
-	if err := session.Delete(*nick + " says goodbye"); err != nil {
-		log.Fatalf("Could not properly delete RobustIRC session: %v", err)
+	outbound.drain(5 * time.Second)
+	if t := currentTransport(); t != nil {
+		if err := t.Close(currentConfig().Nick + " says goodbye"); err != nil {
+			mainLog.Fatal("could not properly close connection", "err", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		mainLog.Error("could not close the state file", "err", err)
 	}
 
 	os.Exit(int(syscall.SIGTERM) | 0x80)
 }
 
 func boot() {
-	if *nickserv_password != "" {
-		Post(fmt.Sprintf("PASS nickserv=%s", *nickserv_password))
+	c := currentConfig()
+	if c.Transport == "irc" {
+		startCapNegotiation()
+	} else if c.NickservPassword != "" {
+		// PASS nickserv= is specific to RobustIRC
+		Post(fmt.Sprintf("PASS nickserv=%s", c.NickservPassword))
+	}
+	resetNick()
+	resetISupport()
+	Post(fmt.Sprintf("NICK %s", wantedNick()))
+	Post(fmt.Sprintf("USER bot 0 * :%s von Bötterich", c.Nick))
+}
+
+func registerModules() {
+	for _, m := range []*Module{
+		helpModule,
+		highlightModule,
+		urifindModule,
+		karmaModule,
+		raumbangModule,
+		manpagesModule,
+		lmgtfyModule,
+		greeterModule,
+		rssModule,
+		topicChangerModule,
+		adminModule,
+		inviteModule,
+	} {
+		ModuleAdd(m)
 	}
-	Post(fmt.Sprintf("NICK %s", *nick))
-	Post(fmt.Sprintf("USER bot 0 * :%s von Bötterich", *nick))
-	setupJoinChannels()
+}
+
+func registerCommands() {
+	CommandAdd(helpCommand)
+	for _, c := range adminCommands {
+		CommandAdd(c)
+	}
+	for _, c := range ignoreCommands {
+		CommandAdd(c)
+	}
+	CommandAdd(unthrottleCommand)
+	CommandAdd(logLevelCommand)
+	for _, c := range highlightCommands {
+		CommandAdd(c)
+	}
+	CommandAdd(karmaCommand)
+	CommandAdd(lmgtfyCommand)
+	CommandAdd(raumCommand)
+	CommandAdd(manCommand)
+}
+
+func registerListeners() {
+	// State tracking runs before all other listeners, in this order.
+	ListenerAdd("capabilities", runnerCap, InPhase(PhaseState))
+	ListenerAdd("isupport", runnerISupport, InPhase(PhaseState))
+	ListenerAdd("nick", runnerNick, InPhase(PhaseState))
+	ListenerAdd("self prefix", runnerSelfPrefix, InPhase(PhaseState))
+	// Needs to see QUITs before the members are updated.
+	ListenerAdd("greeter state", runnerGreetQuit, InPhase(PhaseState))
+	ListenerAdd("updateMembers", runnerMembers, InPhase(PhaseState))
+	// Only trusts accounts of users who share a channel with us.
+	ListenerAdd("accounts", runnerAccounts, InPhase(PhaseState))
+
+	ListenerAdd("join channels", runnerJoinChannels)
+	ListenerAdd("commands", runnerCommands, Concurrent(), Timeout(30*time.Second))
+	ListenerAdd("karma", runnerKarma)
+	ListenerAdd("invite", runnerInvite)
+	ListenerAdd("urifind", runnerUrifind, Concurrent())
+	ListenerAdd("greeter", runnerGreet)
+	ListenerAdd("manpages", runnerManpages, Concurrent())
+	ListenerAdd("topicchanger", runnerTopicChanger, Concurrent())
 }
 
 func main() {
+	// Modules must be known before the config is validated.
+	registerModules()
 	setupFlags()
-
-	if *listenHttp != "" {
+	if flag.NArg() > 0 {
+		if err := runSubcommand(flag.Args()); err != nil {
+			mainLog.Fatal("subcommand failed", "subcommand", flag.Arg(0), "err", err)
+		}
+		return
+	}
+	checkConnectionConfig()
+	setupStore()
+	loadState()
+	setupOutbound()
+	readGreeting()
+
+	if addr := currentConfig().ListenHTTP; addr != "" {
+		http.HandleFunc("/debug/channels", serveChannels)
+		http.HandleFunc("/debug/log", serveLogLevels)
+		http.Handle("/metrics", promhttp.Handler())
 		go func() {
-			log.Fatal(http.ListenAndServe(*listenHttp, nil))
+			mainLog.Fatal("HTTP server failed", "err", http.ListenAndServe(addr, nil))
 		}()
 	}
 
-	setupSession()
 	setupSignalHandler()
 	setupKeepalive()
-	setupSessionErrorHandler()
-	boot()
 
 	go TopicChanger()
 	go Rss()
 
-	ListenerAdd("help", runnerHelp)
-	ListenerAdd("admin", runnerAdmin)
-	ListenerAdd("highlight", runnerHighlight)
-	ListenerAdd("karma", runnerKarma)
-	ListenerAdd("invite", runnerInvite)
-	ListenerAdd("lmgtfy", runnerLmgtfy)
-	ListenerAdd("urifind", runnerUrifind)
-	ListenerAdd("raumbang", runnerRaumbang)
-	ListenerAdd("greeter", runnerGreet)
-	ListenerAdd("manpages", runnerManpages)
-	// Keep this last, so that other runners can access the name lists
-	ListenerAdd("updateMembers", runnerMembers)
+	registerCommands()
+	registerListeners()
 
-	ListenerAdd("topicchanger", runnerTopicChanger)
-
-	if *verbose {
-		ListenerAdd("verbose debugger", func(parsed *irc.Message) error {
-			log.Printf("< PREFIX=%s COMMAND=%s PARAMS=%s TRAILING=%s", parsed.Prefix, parsed.Command, parsed.Params, parsed.Trailing())
-			return nil
-		})
-	}
-
-	ListenerAdd("nickname checker", func(parsed *irc.Message) error {
-		if parsed.Command == irc.ERR_NICKNAMEINUSE {
-			log.Printf("Nickname is already in use. Sleeping for a minute before restarting.")
-			time.Sleep(time.Minute)
-			log.Printf("Killing now due to nickname being in use")
-			kill()
-		}
-		return nil
-	})
-
-	for raw := range session.Messages {
-		msg := irc.ParseMessage(raw)
-		if msg == nil {
-			continue // message could not be parsed
-		}
-
-		if msg.Command == irc.PONG {
-			continue
-		}
-
-		if err := listenersRun(msg); err != nil {
-			log.Printf("error processing %q (%#v): %v", raw, msg, err)
-		}
-	}
+	superviseSession()
 }
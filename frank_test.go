@@ -1,9 +1,95 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 )
 
 func TestItBuilds(t *testing.T) {
 
 }
+
+// TestConcurrentLoad feeds the real listeners with messages from many
+// goroutines at once. It is meant to be run with -race.
+func TestConcurrentLoad(t *testing.T) {
+	oldStore := store
+	defer func() { store = oldStore }()
+	store = newMemoryStore()
+
+	c := defaultConfig()
+	c.Channels = []string{"#load", "#test"}
+	c.Greeter.Channels = []string{"#load"}
+	withConfig(t, c)
+
+	withOutbound(t, 1000)
+
+	oldListeners := listeners
+	defer func() { listeners = oldListeners }()
+	listeners = nil
+	registerModules()
+	registerCommands()
+	registerListeners()
+
+	// no URLs, manpages or topics: those would hit the network
+	templates := []string{
+		":user%d!u@host%d JOIN #load",
+		":frank!frank@bot 353 frank = #load :@op +voice user%d user%d guest%d",
+		":user%d!u@host%d PRIVMSG #load :thing%d++",
+		":user%d!u@host%d PRIVMSG #load :thing%d-- # meh",
+		":user%d!u@host%d PRIVMSG #load :!karma thing%d",
+		":user%d!u@host%d PRIVMSG #load :frank: karma for thing%d?",
+		":user%d!u@host%d PRIVMSG frank :help",
+		":user%d!u@host%d PRIVMSG frank :help karma%d",
+		":user%d!u@host%d PRIVMSG #test :just chatting %d",
+		":user%d!u@host%d NICK renamed%d",
+		":user%d!u@host%d PART #load :bye %d",
+		":user%d!u@host%d QUIT :gone %d",
+	}
+
+	const workers = 16
+	const perWorker = 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				tmpl := templates[(w+i)%len(templates)]
+				n := (w*perWorker + i) % 7
+				msg := parseMessage(fmt.Sprintf(tmpl, n, n, n))
+				if err := listenersRun(msg); err != nil {
+					t.Errorf("listenersRun(%q): %v", msg, err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestJoinChannelsAfterWelcome(t *testing.T) {
+	c := defaultConfig()
+	c.Channels = []string{"#test"}
+	withConfig(t, c)
+
+	withOutbound(t, 10)
+
+	// JOINs before RPL_WELCOME would be rejected
+	boot()
+	for {
+		line, ok := outbound.peek()
+		if !ok {
+			break
+		}
+		outbound.pop()
+		if strings.HasPrefix(line, "JOIN") {
+			t.Errorf("sent %q while registering", line)
+		}
+	}
+
+	runnerJoinChannels(nil, parseMessage(":irc.example.net 001 frank :Welcome"))
+	if line, _ := outbound.peek(); line != "JOIN #test" {
+		t.Errorf("sent %q after RPL_WELCOME, want JOIN #test", line)
+	}
+}
@@ -4,9 +4,12 @@ go 1.16
 
 require (
 	github.com/lib/pq v1.10.1
+	github.com/prometheus/client_golang v1.10.0
 	github.com/robustirc/bridge v1.7.3
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/net v0.0.0-20210505214959-0714010a04ed
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	golang.org/x/sys v0.7.0 // indirect
 	golang.org/x/text v0.3.6
 	gopkg.in/sorcix/irc.v2 v2.0.0-20200812151606-3f15758ea8c7
 )
@@ -2,32 +2,35 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
+	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"os"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
-
-	"gopkg.in/sorcix/irc.v2"
 )
 
+var greeterLog = newLogger("greeter")
+
 var lastSeenLimit = 30 * 24 * time.Hour
 var lastSeenWriteThresh = time.Minute
-var greeting *template.Template
+
+// the greeting template, replaced on reload
+var greeting = struct {
+	mtx sync.Mutex
+	t   *template.Template
+}{}
 
 // maps channel -> (nick -> last seen)
 var lastSeen = struct {
 	mtx sync.Mutex
 	m   map[string]map[string]time.Time
-}{}
+}{m: make(map[string]map[string]time.Time)}
 
-func init() {
-	readLastSeen()
-	readGreeting()
+var greeterModule = &Module{
+	Name:        "greeter",
+	Description: "greets people who join for the first time",
 }
 
 func touchLastSeen(channel string, nick string) (absent time.Duration) {
@@ -44,9 +47,8 @@ func touchLastSeen(channel string, nick string) (absent time.Duration) {
 	return time.Now().Sub(t)
 }
 
-func runnerGreet(parsed *irc.Message) error {
-	botnick := *nick
-	if botnick == Nick(parsed) {
+func runnerGreet(ctx context.Context, parsed *Message) error {
+	if isMe(Nick(parsed)) {
 		// we ignore ourselves
 		return nil
 	}
@@ -55,130 +57,175 @@ func runnerGreet(parsed *irc.Message) error {
 	var channel string
 	switch parsed.Command {
 	case "JOIN":
-		channel = parsed.Trailing()
+		// not Trailing(): with extended-join, account and realname follow
+		channel = parsed.Param(0)
 	case "PART":
 		channel = Target(parsed)
 	case "PRIVMSG":
 		channel = Target(parsed)
-	case "QUIT":
-		// QUIT affects all channels. We check if that nick in in #chaos-hd, if
-		// so, let's set channel to that.
-		if IsMember(nick, "#chaos-hd") {
-			channel = "#chaos-hd"
-		}
 	}
 
-	// TODO: Make channels configurable
-	if channel != "#chaos-hd" {
+	if !isChannel(channel) {
 		return nil
 	}
 
-	if channel == "" || channel[0] != '#' {
-		log.Printf("Not greeting in non-channel %q", channel)
+	if !moduleEnabled("greeter", channel) {
 		return nil
 	}
 
-	// To handle renames of users correctly, we also save the hostmask. Only if
-	// we've seen neither it's a genuinely new user. We strip trailing _, they
-	// usually appear for duplicate links when the original nick is taken by a
-	// ghost.
-	absentNick := touchLastSeen(channel, strings.TrimRight(nick, "_"))
-	absentHostmask := touchLastSeen(channel, Hostmask(parsed))
-	seen := (absentNick <= lastSeenLimit) || (absentHostmask <= lastSeenLimit)
+	seen := touchUser(parsed, channel)
 	if parsed.Command == "JOIN" && !seen {
-		log.Printf("I have not seen %q in %q recently, so I'm greeting them", nick, channel)
+		greeterLog.Info("greeting user not seen recently", "nick", nick, "channel", channel)
 
 		params := struct {
 			Nick string
 			Bot  string
-		}{nick, botnick}
+		}{nick, currentNick()}
 
 		var msg string
 
+		greeting := currentGreeting()
+		if t := channelSettings(currentConfig(), channel).greeting; t != nil {
+			greeting = t
+		}
+
 		msgBuf := new(bytes.Buffer)
 		if greeting == nil {
 			msg = fmt.Sprintf("Hey %s! o/", nick)
 		} else if err := greeting.Execute(msgBuf, params); err != nil {
-			log.Println("Could not render greeting:", err)
+			greeterLog.Warn("could not render greeting", "err", err)
 			msg = fmt.Sprintf("Hey %s! o/", nick)
 		} else {
 			msg = msgBuf.String()
 		}
 		Privmsg(channel, msg)
+		greetingsSent.WithLabelValues(channel).Inc()
 	}
 
+	return nil
+}
+
+// runnerGreetQuit records when users quit. QUIT affects all channels, so it
+// needs to run before the members are updated, otherwise we would no longer
+// know which channels the user was in.
+func runnerGreetQuit(ctx context.Context, parsed *Message) error {
+	if parsed.Command != "QUIT" {
+		return nil
+	}
+	for _, channel := range ChannelsOf(Nick(parsed)) {
+		if moduleEnabled("greeter", channel) {
+			touchUser(parsed, channel)
+		}
+	}
+	return nil
+}
+
+// touchUser records that the sender of parsed was active in channel and
+// reports whether we have seen them recently.
+func touchUser(parsed *Message, channel string) (seen bool) {
+	// To handle renames of users correctly, we also save the hostmask. Only if
+	// we've seen neither it's a genuinely new user. We strip trailing _, they
+	// usually appear for duplicate links when the original nick is taken by a
+	// ghost.
+	channel = fold(channel)
+	absentNick := touchLastSeen(channel, fold(strings.TrimRight(Nick(parsed), "_")))
+	absentHostmask := touchLastSeen(channel, Hostmask(parsed))
+
 	if absentNick > lastSeenWriteThresh || absentHostmask > lastSeenWriteThresh {
 		writeLastSeen()
 	}
 
-	return nil
+	return (absentNick <= lastSeenLimit) || (absentHostmask <= lastSeenLimit)
+}
+
+const lastSeenNamespace = "last-seen"
+
+// lastSeenKey returns the key under which the last-seen time of nick in
+// channel is stored. Neither can contain spaces.
+func lastSeenKey(channel, nick string) string {
+	return channel + " " + nick
+}
+
+func splitLastSeenKey(key string) (channel, nick string, err error) {
+	fields := strings.SplitN(key, " ", 2)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("invalid last-seen key %q", key)
+	}
+	return fields[0], fields[1], nil
 }
 
 func writeLastSeen() {
 	lastSeen.mtx.Lock()
 	defer lastSeen.mtx.Unlock()
 
-	log.Println("Writing last-seen")
-
-	// Take out the garbage
-	for _, c := range lastSeen.m {
-		for nick, last := range c {
-			if time.Now().Sub(last) > lastSeenLimit {
-				delete(c, nick)
+	greeterLog.Debug("writing last-seen")
+
+	err := store.Update(func(tx Tx) error {
+		for channel, c := range lastSeen.m {
+			for nick, last := range c {
+				key := lastSeenKey(channel, nick)
+				// Take out the garbage
+				if time.Now().Sub(last) > lastSeenLimit {
+					delete(c, nick)
+					if err := tx.Delete(lastSeenNamespace, key); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := putJSON(tx, lastSeenNamespace, key, last); err != nil {
+					return err
+				}
 			}
 		}
-	}
-
-	// We write the file atomically to prevent corruption
-	tmp, err := ioutil.TempFile(".", ".last-seen")
+		return nil
+	})
 	if err != nil {
-		log.Println("Could not create temporary file for last-seen:", err)
-		return
-	}
-	defer os.Remove(tmp.Name())
-
-	if err := gob.NewEncoder(tmp).Encode(lastSeen.m); err != nil {
-		log.Println("Could not write last-seen:", err)
-		return
-	}
-
-	if err := os.Rename(tmp.Name(), "last-seen"); err != nil {
-		log.Println("Could not write last-seen:", err)
-		return
+		greeterLog.Error("could not write last-seen", "err", err)
 	}
 }
 
-func readLastSeen() {
+func loadLastSeen() {
 	lastSeen.mtx.Lock()
 	defer lastSeen.mtx.Unlock()
 
-	// Make sure, lastSeen is initialized to a sane, if empty, value.
-	defer func() {
-		if lastSeen.m == nil {
-			lastSeen.m = make(map[string]map[string]time.Time)
-		}
-	}()
-
-	f, err := os.Open("last-seen")
+	m := make(map[string]map[string]time.Time)
+	err := store.View(func(tx Tx) error {
+		return tx.ForEach(lastSeenNamespace, func(key string, value []byte) error {
+			channel, nick, err := splitLastSeenKey(key)
+			if err != nil {
+				return err
+			}
+			var last time.Time
+			if err := json.Unmarshal(value, &last); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			if m[channel] == nil {
+				m[channel] = make(map[string]time.Time)
+			}
+			m[channel][nick] = last
+			return nil
+		})
+	})
 	if err != nil {
-		log.Println("Could not read last-seen:", err)
-		return
-	}
-	defer f.Close()
-
-	var m map[string]map[string]time.Time
-	if err := gob.NewDecoder(f).Decode(&m); err != nil {
-		log.Println("Could not read last-seen:", err)
+		greeterLog.Error("could not read last-seen", "err", err)
 		return
 	}
 	lastSeen.m = m
 }
 
+func currentGreeting() *template.Template {
+	greeting.mtx.Lock()
+	defer greeting.mtx.Unlock()
+	return greeting.t
+}
+
 func readGreeting() {
-	t, err := template.ParseFiles("greeting.txt")
+	t, err := template.ParseFiles(currentConfig().Greeter.Template)
 	if err != nil {
-		log.Println("Could not parse greeting:", err)
+		greeterLog.Warn("could not parse greeting", "err", err)
 		return
 	}
-	greeting = t
+	greeting.mtx.Lock()
+	defer greeting.mtx.Unlock()
+	greeting.t = t
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGreetJoin(t *testing.T) {
+	c := defaultConfig()
+	c.Greeter.Channels = []string{"#test"}
+	withConfig(t, c)
+	withOutbound(t, 10)
+
+	oldStore := store
+	defer func() { store = oldStore }()
+	store = newMemoryStore()
+
+	lastSeen.mtx.Lock()
+	oldLastSeen := lastSeen.m
+	lastSeen.m = make(map[string]map[string]time.Time)
+	lastSeen.mtx.Unlock()
+	defer func() {
+		lastSeen.mtx.Lock()
+		defer lastSeen.mtx.Unlock()
+		lastSeen.m = oldLastSeen
+	}()
+
+	oldGreeting := currentGreeting()
+	greeting.mtx.Lock()
+	greeting.t = nil
+	greeting.mtx.Unlock()
+	defer func() {
+		greeting.mtx.Lock()
+		defer greeting.mtx.Unlock()
+		greeting.t = oldGreeting
+	}()
+
+	for _, tc := range []struct {
+		line, want string
+	}{
+		{":alice!a@example.net JOIN #test", "PRIVMSG #test :Hey alice! o/"},
+		// extended-join: the realname is the trailing parameter
+		{":bob!b@bob.example.net JOIN #test bob :Bob Realname", "PRIVMSG #test :Hey bob! o/"},
+		// seen before
+		{":bob!b@bob.example.net JOIN #test bob :Bob Realname", ""},
+	} {
+		if err := runnerGreet(nil, parseMessage(tc.line)); err != nil {
+			t.Fatal(err)
+		}
+		line, ok := outbound.peek()
+		if ok {
+			outbound.pop()
+		}
+		if line != tc.want {
+			t.Errorf("after %q sent %q, want %q", tc.line, line, tc.want)
+		}
+	}
+}
@@ -1,59 +1,105 @@
 package main
 
 import (
-	"log"
 	"strings"
 	"time"
-
-	"gopkg.in/sorcix/irc.v2"
 )
 
-var lastHelps = map[string]time.Time{}
-
-func runnerHelp(parsed *irc.Message) error {
-	n := Nick(parsed)
+// help answers with many lines, so users must not ask too often
+var helpRateLimit = newRateLimiter("help", 1, time.Minute)
 
-	if !IsPrivateQuery(parsed) {
-		return nil
-	}
+var helpModule = &Module{
+	Name:        "help",
+	Description: "this help",
+}
 
-	content := strings.ToLower(parsed.Trailing())
+var helpCommand = &Command{
+	Module:   "help",
+	Name:     "help",
+	Usage:    "[command]",
+	Help:     "lists what the bot can do, or explains a single command",
+	Examples: []string{"help", "help karma"},
+	MaxArgs:  1,
+	Query:    true,
+	// admins also get to see their commands
+	RoleAware: true,
+	RateLimit: helpRateLimit,
+	Run:       runHelp,
+}
 
-	if content != "help" && content != "!help" {
-		// no help request, ignore
+func runHelp(inv *Invocation) error {
+	if len(inv.Args) > 0 {
+		for _, line := range commandHelp(strings.TrimPrefix(inv.Args[0], "!"), inv.Role) {
+			inv.ReplyPrivately(line)
+		}
 		return nil
 	}
-
-	last := lastHelps[n]
-	if time.Since(last).Minutes() <= 1 {
-		log.Printf("User %s tried spamming for help, not answering (last request @ %v)", n, last)
-		return nil
+	for _, line := range modulesHelp(inv.Role) {
+		inv.ReplyPrivately(line)
 	}
+	return nil
+}
 
-	lastHelps[n] = time.Now()
-
-	Privmsg(n, "1. Test your IRC client’s highlighting:")
-	Privmsg(n, "  – /msg "+*nick+" high")
-	Privmsg(n, "  – /msg "+*nick+" high custom_text")
-	Privmsg(n, "  – /msg "+*nick+" highpub custom_text")
-	Privmsg(n, "“high” sends you a private message, “highpub” posts to #test.")
-	Privmsg(n, "Your nick will be used unless custom_text is defined. Delay is always 5 seconds.")
-	Privmsg(n, " ")
-
-	Privmsg(n, "2. I won’t spoiler URLs if you add “no spoiler” to your message")
-	Privmsg(n, " ")
-
-	Privmsg(n, "3. There’s a karma system. You can’t vote on yourself.")
-	Privmsg(n, "  – thing++ # optional comment")
-	Privmsg(n, "  – thing-- # thing may be alphanumerical, Unicode is supported")
-	Privmsg(n, "  – karma for thing  //  karma thing  //  karma thing?")
-	Privmsg(n, " ")
+// commandUsage returns how a command is invoked, e.g. “!karma <thing>” or
+// “/msg frank help [command]”.
+func commandUsage(c *Command) []string {
+	var usages []string
+	if c.Channel {
+		usages = append(usages, strings.TrimSpace("!"+c.Name+" "+c.Usage))
+	}
+	if c.Query {
+		usages = append(usages, strings.TrimSpace("/msg "+currentNick()+" "+c.Name+" "+c.Usage))
+	}
+	return usages
+}
 
-	Privmsg(n, "4. I’ll answer to !raum in certain channels.")
-	Privmsg(n, " ")
+// modulesHelp briefly lists all modules and the commands available to users
+// with role.
+func modulesHelp(role Role) []string {
+	lines := []string{"I can do the following:"}
+	for _, m := range allModules() {
+		if m.AdminOnly && role == RoleNone {
+			continue
+		}
+		var names []string
+		for _, c := range moduleCommands(m.Name) {
+			if c.Role <= role {
+				names = append(names, c.Name)
+			}
+		}
+		line := "  – " + m.Name + ": " + m.Description
+		if len(names) > 0 {
+			line += " (commands: " + strings.Join(names, ", ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	return append(lines,
+		"Use “help <command>” for details on a command.",
+		"If you need more details, please look at my source: https://github.com/nnev/frank")
+}
 
-	Privmsg(n, "If you need more details, please look at my source:")
-	Privmsg(n, "https://github.com/nnev/frank")
+// commandHelp explains a single command to a user with role.
+func commandHelp(name string, role Role) []string {
+	c := commandByName(name)
+	if c == nil || c.Role > role {
+		return []string{"There is no command “" + name + "”, try “help” for a list."}
+	}
 
-	return nil
+	lines := []string{c.Name + ": " + c.Help}
+	for _, usage := range commandUsage(c) {
+		lines = append(lines, "  usage: "+usage)
+	}
+	if len(c.Aliases) > 0 {
+		lines = append(lines, "  aliases: "+strings.Join(c.Aliases, ", "))
+	}
+	if c.NoPrefix {
+		lines = append(lines, "  in channels, the “!” can be omitted")
+	}
+	for _, example := range c.Examples {
+		lines = append(lines, "  example: "+example)
+	}
+	if c.Role > RoleNone {
+		lines = append(lines, "  only available to admins with role "+c.Role.String()+" or higher")
+	}
+	return lines
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHelp(t *testing.T) {
+	withCommands(t)
+	ModuleAdd(&Module{Name: "helptest", Description: "a module for testing"})
+	ModuleAdd(&Module{Name: "helptestadmin", Description: "secret", AdminOnly: true})
+	CommandAdd(&Command{
+		Module:   "helptest",
+		Name:     "helpme",
+		Aliases:  []string{"hm"},
+		Usage:    "<thing>",
+		Help:     "helps with thing",
+		Examples: []string{"helpme frank"},
+		Channel:  true,
+		Query:    true,
+	})
+	CommandAdd(&Command{
+		Module: "helptest",
+		Name:   "helpadmin",
+		Help:   "for admins only",
+		Query:  true,
+		Role:   RoleOperator,
+	})
+
+	user := strings.Join(modulesHelp(RoleNone), "\n")
+	if !strings.Contains(user, "  – helptest: a module for testing (commands: helpme)") {
+		t.Errorf("modulesHelp(RoleNone) does not list the helptest module:\n%s", user)
+	}
+	if strings.Contains(user, "secret") {
+		t.Errorf("modulesHelp(RoleNone) lists an admin only module:\n%s", user)
+	}
+
+	admin := strings.Join(modulesHelp(RoleOwner), "\n")
+	if !strings.Contains(admin, "(commands: helpme, helpadmin)") || !strings.Contains(admin, "secret") {
+		t.Errorf("modulesHelp(RoleOwner) does not list everything:\n%s", admin)
+	}
+
+	want := []string{
+		"helpme: helps with thing",
+		"  usage: !helpme <thing>",
+		"  usage: /msg frank helpme <thing>",
+		"  aliases: hm",
+		"  example: helpme frank",
+	}
+	if got := commandHelp("hm", RoleNone); !reflect.DeepEqual(got, want) {
+		t.Errorf("commandHelp(hm) = %q, want %q", got, want)
+	}
+
+	if got := commandHelp("helpadmin", RoleTrusted); !strings.HasPrefix(got[0], "There is no command") {
+		t.Errorf("commandHelp(helpadmin) explains an admin command to a user: %q", got)
+	}
+	if got := commandHelp("helpadmin", RoleOwner); got[len(got)-1] != "  only available to admins with role operator or higher" {
+		t.Errorf("commandHelp(helpadmin) = %q, does not mention admins", got)
+	}
+}
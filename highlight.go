@@ -1,49 +1,76 @@
 package main
 
 import (
-	"log"
-	"regexp"
-	"strings"
+	"context"
 	"time"
-
-	"gopkg.in/sorcix/irc.v2"
 )
 
-var highlightRe = regexp.MustCompile(`^(?:highpub|high)(?:\s+(.{1,70}))*`)
+var highlightLog = newLogger("highlight")
 
-func runnerHighlight(msg *irc.Message) error {
-	// Only accept highlight request via queries (as opposed to in
-	// channels).
-	if msg.Command != irc.PRIVMSG ||
-		len(msg.Params) < 1 ||
-		strings.HasPrefix(msg.Params[0], "#") {
-		return nil
-	}
+// longer custom texts are cut off
+const highlightMaxLength = 70
 
-	matches := highlightRe.FindStringSubmatch(msg.Trailing())
-	if matches == nil {
-		return nil // no highlight request
-	}
+var highlightModule = &Module{
+	Name:        "highlight",
+	Description: "tests your IRC client’s highlighting. Your nick is used unless you specify a custom text",
+}
+
+// shared by high and highpub
+var highlightRateLimit = newRateLimiter("highlight", 3, time.Minute)
 
-	nick := msg.Prefix.Name // for convenience
-	log.Printf("received highlighting request from %s: %#v", nick, matches)
+var highlightCommands = []*Command{
+	{
+		Module:    "highlight",
+		Name:      "high",
+		Examples:  []string{"high", "high custom_text"},
+		Usage:     "[custom_text]",
+		Help:      "highlights you privately after 5 seconds",
+		MaxArgs:   1,
+		Query:     true,
+		RateLimit: highlightRateLimit,
+		Run:       runHighlight,
+	},
+	{
+		Module:    "highlight",
+		Name:      "highpub",
+		Examples:  []string{"highpub custom_text"},
+		Usage:     "[custom_text]",
+		Help:      "highlights you in #test after 5 seconds",
+		MaxArgs:   1,
+		Query:     true,
+		RateLimit: highlightRateLimit,
+		Run:       runHighlight,
+	},
+}
+
+func runHighlight(inv *Invocation) error {
+	nick := inv.Nick // for convenience
+	highlightLog.Info("received highlighting request", "nick", nick, "args", inv.Args)
 	highlight := nick
-	if matches[1] != "" {
-		highlight = matches[1]
+	if len(inv.Args) > 0 {
+		highlight = inv.Args[0]
+		highlight = highlight[:runeBoundary(highlight, highlightMaxLength)]
 	}
 
 	Privmsg(nick, "will highlight you in 5 seconds")
 
-	// allow for 100ms round trip time to highlight on time
-	time.Sleep(4900 * time.Millisecond)
-
-	if strings.HasPrefix(msg.Trailing(), "highpub") {
-		log.Printf("highlighting %s publicly for: %s", nick, highlight)
-		Privmsg("#test", "highlight test: "+highlight)
-	} else {
-		log.Printf("highlighting %s privately for: %s", nick, highlight)
-		Privmsg(nick, highlight)
-	}
+	// allow for 100ms round trip time to highlight on time. Waiting in
+	// the background keeps the commands listener from waiting for us.
+	public := inv.Cmd.Name == "highpub"
+	Spawn(inv.Ctx, "highlight", 10*time.Second, func(ctx context.Context) {
+		select {
+		case <-time.After(4900 * time.Millisecond):
+		case <-ctx.Done():
+			return
+		}
+		if public {
+			highlightLog.Info("highlighting publicly", "nick", nick, "highlight", highlight)
+			Privmsg("#test", "highlight test: "+highlight)
+		} else {
+			highlightLog.Info("highlighting privately", "nick", nick, "highlight", highlight)
+			Privmsg(nick, highlight)
+		}
+	})
 
 	return nil
 }
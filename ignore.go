@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ignoreNamespace = "ignore"
+
+// ignoreEntry makes frank ignore everybody whose nick!user@host matches Mask.
+// Ignored users are still tracked (members, accounts, …), but no listener
+// reacts to them.
+type ignoreEntry struct {
+	Mask  string    `json:"mask"`
+	Added time.Time `json:"added"`
+	// By is the nick of the admin who added the entry.
+	By string `json:"by"`
+	// Expires is zero for entries which never expire.
+	Expires time.Time `json:"expires,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+func (e ignoreEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+func (e ignoreEntry) String() string {
+	s := fmt.Sprintf("%s (by %s on %s", e.Mask, e.By, e.Added.Format("2006-01-02"))
+	if e.Expires.IsZero() {
+		s += ", forever"
+	} else {
+		s += ", until " + e.Expires.Format("2006-01-02 15:04")
+	}
+	s += ")"
+	if e.Reason != "" {
+		s += ": " + e.Reason
+	}
+	return s
+}
+
+// ignores is the ignore list, mask → entry. It is kept in memory because it
+// is consulted for every message.
+var ignores = struct {
+	mtx sync.Mutex
+	m   map[string]ignoreEntry
+}{m: make(map[string]ignoreEntry)}
+
+// normalizeIgnoreMask turns a nick glob into a hostmask glob.
+func normalizeIgnoreMask(mask string) (string, error) {
+	if mask == "" || strings.ContainsAny(mask, " ,") {
+		return "", fmt.Errorf("invalid mask %q", mask)
+	}
+	if !strings.Contains(mask, "!") && !strings.Contains(mask, "@") {
+		return mask + "!*@*", nil
+	}
+	if !strings.Contains(mask, "!") || !strings.Contains(mask, "@") {
+		return "", fmt.Errorf("mask %q must be a nick or look like nick!user@host", mask)
+	}
+	return mask, nil
+}
+
+// parseIgnoreDuration parses durations like "90m", "12h" or "7d".
+func parseIgnoreDuration(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", s)
+	}
+	return d, nil
+}
+
+// isIgnored reports whether the sender of msg is on the ignore list.
+func isIgnored(msg *Message) bool {
+	if msg.Prefix == nil || msg.Prefix.User == "" {
+		// the server, or frank itself
+		return false
+	}
+	prefix := msg.Prefix.String()
+	now := time.Now()
+
+	ignores.mtx.Lock()
+	defer ignores.mtx.Unlock()
+	for _, e := range ignores.m {
+		if !e.expired(now) && matchMask(e.Mask, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func addIgnore(e ignoreEntry) error {
+	ignores.mtx.Lock()
+	defer ignores.mtx.Unlock()
+	err := store.Update(func(tx Tx) error {
+		return putJSON(tx, ignoreNamespace, e.Mask, e)
+	})
+	if err != nil {
+		return err
+	}
+	ignores.m[e.Mask] = e
+	return nil
+}
+
+// removeIgnore removes mask from the ignore list. found is false if it was
+// not on it.
+func removeIgnore(mask string) (found bool, err error) {
+	ignores.mtx.Lock()
+	defer ignores.mtx.Unlock()
+	if _, ok := ignores.m[mask]; !ok {
+		return false, nil
+	}
+	err = store.Update(func(tx Tx) error {
+		return tx.Delete(ignoreNamespace, mask)
+	})
+	if err != nil {
+		return true, err
+	}
+	delete(ignores.m, mask)
+	return true, nil
+}
+
+// ignoreList returns the ignore list sorted by mask, after dropping expired
+// entries.
+func ignoreList() []ignoreEntry {
+	now := time.Now()
+	ignores.mtx.Lock()
+	defer ignores.mtx.Unlock()
+
+	var list, expired []ignoreEntry
+	for _, e := range ignores.m {
+		if e.expired(now) {
+			expired = append(expired, e)
+		} else {
+			list = append(list, e)
+		}
+	}
+	if len(expired) > 0 {
+		err := store.Update(func(tx Tx) error {
+			for _, e := range expired {
+				if err := tx.Delete(ignoreNamespace, e.Mask); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			authLog.Warn("could not remove expired ignores", "err", err)
+		} else {
+			for _, e := range expired {
+				delete(ignores.m, e.Mask)
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Mask < list[j].Mask })
+	return list
+}
+
+func loadIgnores() {
+	ignores.mtx.Lock()
+	defer ignores.mtx.Unlock()
+
+	m := make(map[string]ignoreEntry)
+	err := store.View(func(tx Tx) error {
+		return tx.ForEach(ignoreNamespace, func(key string, value []byte) error {
+			var e ignoreEntry
+			if err := json.Unmarshal(value, &e); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			m[e.Mask] = e
+			return nil
+		})
+	})
+	if err != nil {
+		authLog.Error("could not read ignore list", "err", err)
+		return
+	}
+	ignores.m = m
+}
+
+var ignoreCommands = []*Command{
+	{
+		Module: "admin",
+		Name:   "ignore",
+		Usage:  "<nick or nick!user@host> [duration] [reason]",
+		Help:   "ignores a user or bot, forever or for a duration like 90m, 12h or 7d",
+		Examples: []string{
+			"ignore otherbot",
+			"ignore *!*@spammer.example.net 7d karma spam",
+		},
+		MinArgs: 1,
+		Query:   true,
+		Role:    RoleOperator,
+		Run: func(inv *Invocation) error {
+			mask, err := normalizeIgnoreMask(inv.Args[0])
+			if err != nil {
+				inv.Reply(err.Error())
+				return nil
+			}
+			if matchMask(mask, inv.Msg.Prefix.String()) {
+				inv.Reply(mask + " matches yourself, you could not unignore it")
+				return nil
+			}
+			e := ignoreEntry{Mask: mask, Added: time.Now(), By: inv.Nick}
+			reason := inv.Args[1:]
+			if len(reason) > 0 {
+				if d, err := parseIgnoreDuration(reason[0]); err == nil {
+					e.Expires = e.Added.Add(d)
+					reason = reason[1:]
+				}
+			}
+			e.Reason = strings.Join(reason, " ")
+			if err := addIgnore(e); err != nil {
+				return err
+			}
+			inv.Reply("ignoring " + e.String())
+			return nil
+		},
+	},
+	{
+		Module:  "admin",
+		Name:    "unignore",
+		Usage:   "<mask>",
+		Help:    "removes a mask from the ignore list",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Query:   true,
+		Role:    RoleOperator,
+		Run: func(inv *Invocation) error {
+			mask, err := normalizeIgnoreMask(inv.Args[0])
+			if err != nil {
+				inv.Reply(err.Error())
+				return nil
+			}
+			found, err := removeIgnore(mask)
+			if err != nil {
+				return err
+			}
+			if !found {
+				inv.Reply(mask + " is not ignored, see ignores")
+				return nil
+			}
+			inv.Reply("no longer ignoring " + mask)
+			return nil
+		},
+	},
+	{
+		Module: "admin",
+		Name:   "ignores",
+		Help:   "lists ignored users and bots",
+		Query:  true,
+		Role:   RoleTrusted,
+		Run: func(inv *Invocation) error {
+			list := ignoreList()
+			if len(list) == 0 {
+				inv.Reply("nobody is ignored")
+			}
+			for _, e := range list {
+				inv.Reply(e.String())
+			}
+			return nil
+		},
+	},
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIgnoreMask(t *testing.T) {
+	for mask, want := range map[string]string{
+		"otherbot":         "otherbot!*@*",
+		"*bot*":            "*bot*!*@*",
+		"*!*@spam.example": "*!*@spam.example",
+		"*@spam.example":   "",
+		"bot!*":            "",
+		"two words!*@*":    "",
+		"":                 "",
+	} {
+		got, err := normalizeIgnoreMask(mask)
+		if want == "" {
+			if err == nil {
+				t.Errorf("normalizeIgnoreMask(%q) = %q, want error", mask, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("normalizeIgnoreMask(%q) = %q, %v, want %q", mask, got, err, want)
+		}
+	}
+
+	for s, want := range map[string]time.Duration{
+		"90m":  90 * time.Minute,
+		"7d":   7 * 24 * time.Hour,
+		"0d":   0,
+		"-1h":  0,
+		"spam": 0,
+	} {
+		got, err := parseIgnoreDuration(s)
+		if (err == nil) != (want != 0) || got != want {
+			t.Errorf("parseIgnoreDuration(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	oldStore := store
+	defer func() {
+		store = oldStore
+		loadIgnores()
+	}()
+	store = newMemoryStore()
+	loadIgnores()
+
+	old := listeners
+	defer func() { listeners = old }()
+	listeners = nil
+
+	var ran []string
+	record := func(name string) Runner {
+		return func(context.Context, *Message) error {
+			ran = append(ran, name)
+			return nil
+		}
+	}
+	ListenerAdd("state", record("state"), InPhase(PhaseState))
+	ListenerAdd("react", record("react"))
+
+	now := time.Now()
+	for _, e := range []ignoreEntry{
+		{Mask: "otherbot!*@*", Added: now},
+		{Mask: "*!*@spam.example", Added: now, Expires: now.Add(time.Hour)},
+		{Mask: "former!*@*", Added: now.Add(-time.Hour), Expires: now.Add(-time.Minute)},
+	} {
+		if err := addIgnore(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for msg, want := range map[string][]string{
+		":OtherBot!b@example.net PRIVMSG #chaos-hd :[Link Info] title": {"state"},
+		":alice!a@spam.example PRIVMSG #chaos-hd :go++":                {"state"},
+		":former!f@example.net PRIVMSG #chaos-hd :go++":                {"state", "react"},
+		":alice!a@example.net PRIVMSG #chaos-hd :go++":                 {"state", "react"},
+		":irc.example.net NOTICE * :hello":                             {"state", "react"},
+	} {
+		ran = nil
+		if err := listenersRun(parseMessage(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ran, want) {
+			t.Errorf("for %q, ran %q, want %q", msg, ran, want)
+		}
+	}
+
+	// the expired entry is dropped, the others survive a restart
+	loadIgnores()
+	var masks []string
+	for _, e := range ignoreList() {
+		masks = append(masks, e.Mask)
+	}
+	if want := []string{"*!*@spam.example", "otherbot!*@*"}; !reflect.DeepEqual(masks, want) {
+		t.Errorf("ignoreList() = %q, want %q", masks, want)
+	}
+	loadIgnores()
+	if len(ignoreList()) != 2 {
+		t.Errorf("expired entry was not removed from the store")
+	}
+
+	if found, err := removeIgnore("otherbot!*@*"); !found || err != nil {
+		t.Errorf("removeIgnore = %v, %v", found, err)
+	}
+	if isIgnored(parseMessage(":otherbot!b@example.net PRIVMSG #chaos-hd :hi")) {
+		t.Errorf("otherbot is still ignored")
+	}
+}
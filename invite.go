@@ -1,31 +1,45 @@
 package main
 
 import (
-	"log"
-	"strings"
-
-	"gopkg.in/sorcix/irc.v2"
+	"context"
 )
 
-func runnerInvite(parsed *irc.Message) error {
+var inviteLog = newLogger("invite")
+
+var inviteModule = &Module{
+	Name:        "invite",
+	Description: "follows invites of admins",
+	AdminOnly:   true,
+}
+
+func runnerInvite(ctx context.Context, parsed *Message) error {
 	if parsed.Command != "INVITE" {
 		return nil
 	}
 
-	n := Nick(parsed)
-	if !IsNickAdmin(parsed) && strings.ToLower(n) != "chanserv" {
-		log.Printf("not reacting on invite from non-admin user: %s", n)
+	if !isMe(Target(parsed)) {
+		inviteLog.Warn("invite is not for me", "nick", currentNick(), "target", Target(parsed))
 		return nil
 	}
 
-	if Target(parsed) != *nick {
-		log.Printf("invite: Weird, target is not me? my nick=%s  target=%s", *nick, Target(parsed))
+	channel := parsed.Trailing()
+	if equalFold(Nick(parsed), "ChanServ") {
+		inviteLog.Info("following invite by ChanServ", "channel", channel)
+		Join(channel)
 		return nil
 	}
 
-	channel := parsed.Trailing()
-	log.Printf("Following invite for channel: %s", channel)
-	Join(channel)
-
+	follow := func(role Role) {
+		if role < RoleOperator {
+			inviteLog.Info("not following invite from non-admin user", "nick", Nick(parsed), "channel", channel)
+			return
+		}
+		inviteLog.Info("following invite", "channel", channel, "by", Nick(parsed))
+		audit(parsed, "invite", channel)
+		Join(channel)
+	}
+	if role, ok := userRole(parsed, follow); ok {
+		follow(role)
+	}
 	return nil
 }
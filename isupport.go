@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// isupport holds the server features from RPL_ISUPPORT (005) which frank
+// cares about. Until the server sends them, the RFC 1459 defaults apply.
+var isupport = struct {
+	mtx sync.RWMutex
+	// caseMapping is "ascii", "rfc1459" or "strict-rfc1459", others are
+	// treated like rfc1459
+	caseMapping string
+	// prefixes are the membership prefixes, highest first, e.g. "@+", and
+	// prefixModes the corresponding channel modes, e.g. "ov"
+	prefixes    string
+	prefixModes string
+	chanTypes   string
+	// chanModes are the channel modes by type (CHANMODES): lists, modes
+	// which always take a parameter, modes which take one only when set and
+	// flags
+	chanModes [4]string
+	// nickLen is 0 if unknown
+	nickLen int
+}{
+	caseMapping: "rfc1459",
+	prefixes:    "@+",
+	prefixModes: "ov",
+	chanTypes:   "#&",
+	chanModes:   defaultChanModes,
+}
+
+var defaultChanModes = [4]string{"beI", "k", "l", "imnpst"}
+
+// resetISupport restores the defaults before connecting to a (maybe
+// different) server.
+func resetISupport() {
+	isupport.mtx.Lock()
+	defer isupport.mtx.Unlock()
+	isupport.caseMapping = "rfc1459"
+	isupport.prefixes, isupport.prefixModes = "@+", "ov"
+	isupport.chanTypes = "#&"
+	isupport.chanModes = defaultChanModes
+	isupport.nickLen = 0
+}
+
+// fold returns the canonical form of a nick or channel name according to
+// the server’s CASEMAPPING, for use as a map key. Use equalFold for
+// comparisons.
+func fold(s string) string {
+	isupport.mtx.RLock()
+	caseMapping := isupport.caseMapping
+	isupport.mtx.RUnlock()
+
+	// RFC 1459 considers {}| the lower case of []\, and rfc1459 (unlike
+	// strict-rfc1459) also ^ that of ~.
+	var upper, lower string
+	switch caseMapping {
+	case "ascii":
+	case "strict-rfc1459":
+		upper, lower = `[]\`, "{}|"
+	default:
+		upper, lower = `[]\~`, "{}|^"
+	}
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		if i := strings.IndexRune(upper, r); i != -1 {
+			return rune(lower[i])
+		}
+		return r
+	}, s)
+}
+
+// equalFold reports whether two nicks or channel names are the same.
+func equalFold(a, b string) bool {
+	return fold(a) == fold(b)
+}
+
+// containsFold reports whether list contains name, see equalFold.
+func containsFold(list []string, name string) bool {
+	for _, s := range list {
+		if equalFold(s, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isChannel reports whether name is a channel according to CHANTYPES.
+func isChannel(name string) bool {
+	isupport.mtx.RLock()
+	defer isupport.mtx.RUnlock()
+	return name != "" && strings.IndexByte(isupport.chanTypes, name[0]) != -1
+}
+
+// stripPrefixes splits a nick from RPL_NAMREPLY into the membership prefixes
+// (more than one with multi-prefix) and the nick.
+func stripPrefixes(name string) (prefixes, nick string) {
+	isupport.mtx.RLock()
+	defer isupport.mtx.RUnlock()
+	nick = strings.TrimLeft(name, isupport.prefixes)
+	return name[:len(name)-len(nick)], nick
+}
+
+// prefixMode returns the channel mode corresponding to a membership prefix,
+// e.g. 'o' for '@'.
+func prefixMode(prefix byte) (mode byte, ok bool) {
+	isupport.mtx.RLock()
+	defer isupport.mtx.RUnlock()
+	if i := strings.IndexByte(isupport.prefixes, prefix); i != -1 && i < len(isupport.prefixModes) {
+		return isupport.prefixModes[i], true
+	}
+	return 0, false
+}
+
+// modeTakesParam reports whether the channel mode takes a parameter when it
+// is set (adding) or unset.
+func modeTakesParam(mode byte, adding bool) bool {
+	isupport.mtx.RLock()
+	defer isupport.mtx.RUnlock()
+	switch {
+	case strings.IndexByte(isupport.prefixModes, mode) != -1,
+		strings.IndexByte(isupport.chanModes[0], mode) != -1,
+		strings.IndexByte(isupport.chanModes[1], mode) != -1:
+		return true
+	case strings.IndexByte(isupport.chanModes[2], mode) != -1:
+		return adding
+	}
+	return false
+}
+
+// isPrefixMode reports whether mode is a membership mode like o or v.
+func isPrefixMode(mode byte) bool {
+	isupport.mtx.RLock()
+	defer isupport.mtx.RUnlock()
+	return strings.IndexByte(isupport.prefixModes, mode) != -1
+}
+
+// isListMode reports whether mode is a list like bans (b).
+func isListMode(mode byte) bool {
+	isupport.mtx.RLock()
+	defer isupport.mtx.RUnlock()
+	return strings.IndexByte(isupport.chanModes[0], mode) != -1
+}
+
+// maxNickLen returns the maximum nick length, or 0 if unknown.
+func maxNickLen() int {
+	isupport.mtx.RLock()
+	defer isupport.mtx.RUnlock()
+	return isupport.nickLen
+}
+
+// runnerISupport reads RPL_ISUPPORT:
+// :server 005 <nick> CASEMAPPING=ascii PREFIX=(ov)@+ … :are supported by this server
+func runnerISupport(ctx context.Context, parsed *Message) error {
+	if parsed.Command != irc.RPL_ISUPPORT || len(parsed.Params) < 3 {
+		return nil
+	}
+	isupport.mtx.Lock()
+	defer isupport.mtx.Unlock()
+	for _, token := range parsed.Params[1 : len(parsed.Params)-1] {
+		kv := strings.SplitN(token, "=", 2)
+		key, value := kv[0], ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch key {
+		case "CASEMAPPING":
+			isupport.caseMapping = value
+		case "-CASEMAPPING":
+			isupport.caseMapping = "rfc1459"
+		case "PREFIX":
+			// (modes)prefixes, or empty for none
+			if value == "" {
+				isupport.prefixModes, isupport.prefixes = "", ""
+				continue
+			}
+			idx := strings.IndexByte(value, ')')
+			if !strings.HasPrefix(value, "(") || idx == -1 || idx-1 != len(value)-idx-1 {
+				ircLog.Warn("ignoring invalid PREFIX", "value", value)
+				continue
+			}
+			isupport.prefixModes, isupport.prefixes = value[1:idx], value[idx+1:]
+		case "CHANTYPES":
+			isupport.chanTypes = value
+		case "CHANMODES":
+			types := strings.Split(value, ",")
+			if len(types) < 4 {
+				ircLog.Warn("ignoring invalid CHANMODES", "value", value)
+				continue
+			}
+			copy(isupport.chanModes[:], types)
+		case "NICKLEN":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				ircLog.Warn("ignoring invalid NICKLEN", "value", value)
+				continue
+			}
+			isupport.nickLen = n
+		}
+	}
+	return nil
+}
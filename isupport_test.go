@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestISupport(t *testing.T) {
+	defer resetISupport()
+
+	// RFC 1459 defaults
+	if !equalFold("Frank[m]", "frank{M}") || !equalFold("a~", "A^") {
+		t.Errorf("rfc1459 casemapping not applied by default")
+	}
+	if !isChannel("&local") || isChannel("+modeless") {
+		t.Errorf("default CHANTYPES not applied")
+	}
+
+	msg := parseMessage(":irc.example.net 005 frank CASEMAPPING=strict-rfc1459 PREFIX=(qaohv)~&@%+ CHANTYPES=#+ NICKLEN=12 EXCEPTS :are supported by this server")
+	if err := runnerISupport(nil, msg); err != nil {
+		t.Fatal(err)
+	}
+	if !equalFold("Frank[m]", "frank{M}") || equalFold("a~", "A^") {
+		t.Errorf("strict-rfc1459 casemapping not applied")
+	}
+	if !isChannel("+modeless") || isChannel("&local") {
+		t.Errorf("CHANTYPES not applied")
+	}
+	if prefixes, nick := stripPrefixes("~@frank"); prefixes != "~@" || nick != "frank" {
+		t.Errorf("stripPrefixes(~@frank) = %q, %q", prefixes, nick)
+	}
+	if mode, ok := prefixMode('%'); !ok || mode != 'h' {
+		t.Errorf("prefixMode(%%) = %c, %v, want h", mode, ok)
+	}
+	if got := maxNickLen(); got != 12 {
+		t.Errorf("maxNickLen() = %d, want 12", got)
+	}
+	if got := fallbackNick("averylongnick", "averylongnic"); len(got) != 12 || got[:9] != "averylong" {
+		t.Errorf("fallbackNick ignores NICKLEN: %q", got)
+	}
+	if got := fallbackNick("frank", "frank"); got != "frank_" {
+		t.Errorf("fallbackNick(frank) = %q, want frank_", got)
+	}
+
+	runnerISupport(nil, parseMessage(":irc.example.net 005 frank CASEMAPPING=ascii :are supported by this server"))
+	if equalFold("Frank[m]", "frank{M}") || !equalFold("FRANK", "frank") {
+		t.Errorf("ascii casemapping not applied")
+	}
+}
+
+func TestMembersCaseMapping(t *testing.T) {
+	m := newChannelTracker()
+	m.add("Frank[m]", "#Chaos-HD")
+	if !m.IsMember("frank{m}", "#chaos-hd") {
+		t.Errorf("IsMember ignores the casemapping")
+	}
+	if got, want := m.channelsOf("FRANK[M]"), []string{"#Chaos-HD"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("channelsOf = %q, want %q", got, want)
+	}
+	m.rename("frank{m}", "Frank")
+	if m.IsMember("Frank[m]", "#chaos-hd") || !m.IsMember("frank", "#CHAOS-HD") {
+		t.Errorf("rename ignores the casemapping: %v", m)
+	}
+	m.remove("FRANK", "#chaos-hd")
+	if len(m.channelsOf("frank")) != 0 {
+		t.Errorf("remove ignores the casemapping: %v", m)
+	}
+}
@@ -1,54 +1,82 @@
 package main
 
 import (
-	"encoding/gob"
+	"context"
 	"fmt"
-	"io"
-	"log"
-	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"gopkg.in/sorcix/irc.v2"
 )
 
-const karmaFile = "karma"
+var karmaLog = newLogger("karma")
 
 var (
 	karmaMatcherRegex = regexp.MustCompile(`^([\d\pL]+)(\+\+|--)(?:$|\s#)`)
-	karmaAnswerRegex  = regexp.MustCompile(`(?i)^karma:?\s+(?:for\s+)?([\d\pL]+)\??$`)
+	karmaThingRegex   = regexp.MustCompile(`^[\d\pL]+$`)
 )
 
-var defaultData = map[string]int{"frank": 9999}
-var data = func() map[string]int {
-	f, err := os.Open(karmaFile)
-	if err != nil {
-		log.Printf("could not open karma file %q: %v", karmaFile, err)
-		return defaultData
-	}
-	defer f.Close()
-	result := make(map[string]int)
-	if err := gob.NewDecoder(f).Decode(&result); err != nil {
-		log.Printf("could not read karma file %q: %v", karmaFile, err)
-		return defaultData
-	}
-	return result
-}()
+// votes per user and channel, to keep karma meaningful
+var karmaVoteRateLimit = newRateLimiter("karma voting", 5, 2*time.Minute)
+
+var karmaModule = &Module{
+	Name:        "karma",
+	Description: "a karma system. Say “thing++” or “thing-- # optional comment” in a channel. thing may be alphanumerical, Unicode is supported. You can’t vote on yourself",
+}
+
+var karmaCommand = &Command{
+	Module:   "karma",
+	Name:     "karma",
+	Examples: []string{"karma for thing", "karma thing", "karma thing?"},
+	Aliases:  []string{"karma:"},
+	Usage:    "[for] <thing>[?]",
+	Help:     "shows the karma of thing",
+	MinArgs:  1,
+	Channel:  true,
+	Query:    true,
+	NoPrefix: true,
+	Run:      answer,
+}
+
+const karmaNamespace = "karma"
+
+// karma of things nobody has voted on yet
+var defaultKarma = map[string]int{"frank": 9999}
+
+func karmaGet(thing string) (int, error) {
+	karma := defaultKarma[thing]
+	err := store.View(func(tx Tx) error {
+		_, err := getJSON(tx, karmaNamespace, thing, &karma)
+		return err
+	})
+	return karma, err
+}
+
+// karmaVote changes the karma of thing by delta and returns the new karma.
+func karmaVote(thing string, delta int) (int, error) {
+	karma := defaultKarma[thing]
+	err := store.Update(func(tx Tx) error {
+		if _, err := getJSON(tx, karmaNamespace, thing, &karma); err != nil {
+			return err
+		}
+		karma += delta
+		return putJSON(tx, karmaNamespace, thing, karma)
+	})
+	return karma, err
+}
 
-func runnerKarma(msg *irc.Message) error {
+func runnerKarma(ctx context.Context, msg *Message) error {
 	if msg.Command != irc.PRIVMSG {
 		return nil
 	}
-	if err := match(msg); err != nil {
-		return err
-	}
-	return answer(msg)
+	return match(msg)
 }
 
 // reads the current line for karma-esque expressions and ups/dows the
 // thing that was voted on. A user can’t vote on her/himself.
-func match(msg *irc.Message) error {
-	if len(msg.Params) < 1 || !strings.HasPrefix(msg.Params[0], "#") {
+func match(msg *Message) error {
+	if len(msg.Params) < 1 || !isChannel(msg.Params[0]) {
 		// love/hate needs to be announced publicly to avoid skewing the
 		// results
 		return nil
@@ -62,40 +90,47 @@ func match(msg *irc.Message) error {
 	thing := strings.ToLower(matches[1])
 
 	nick := msg.Prefix.Name
-	if thing == strings.ToLower(nick) {
-		log.Printf("User %s tried to karma her/himself. What a loser!", nick)
+	if equalFold(thing, nick) {
+		karmaLog.Info("user tried to vote for themselves", "nick", nick)
 		Privmsg(nick, "[Karma] Voting on yourself is not supported")
 		return nil
 	}
 
-	if matches[2] == "++" {
-		data[thing] += 1
-	} else {
-		data[thing] -= 1
+	if !karmaVoteRateLimit.Allow(msg, msg.Params[0]) {
+		return nil
 	}
 
-	log.Printf("user %q changed karma (using the %s operator) for %q to %d", nick, matches[2], thing, data[thing])
+	delta := 1
+	if matches[2] == "--" {
+		delta = -1
+	}
+	value, err := karmaVote(thing, delta)
+	if err != nil {
+		return err
+	}
 
-	return writeAtomically(karmaFile, func(w io.Writer) error {
-		return gob.NewEncoder(w).Encode(data)
-	})
+	karmaVotes.WithLabelValues(matches[2]).Inc()
+	karmaLog.Info("karma changed", "nick", nick, "operator", matches[2], "thing", thing, "karma", value)
+	return nil
 }
 
 // answers a user with the current karma for a given thing
-func answer(msg *irc.Message) error {
-	if len(msg.Params) < 1 {
-		return nil
+func answer(inv *Invocation) error {
+	args := inv.Args
+	if len(args) == 2 && strings.ToLower(args[0]) == "for" {
+		args = args[1:]
 	}
-	target := msg.Params[0]
-	if !strings.HasPrefix(target, "#") {
-		target = msg.Prefix.Name
+	if len(args) != 1 {
+		return nil
 	}
-
-	matches := karmaAnswerRegex.FindStringSubmatch(msg.Trailing())
-	if matches == nil {
+	thing := strings.TrimSuffix(args[0], "?")
+	if !karmaThingRegex.MatchString(thing) {
 		return nil
 	}
-	thing := matches[1]
-	Privmsg(target, fmt.Sprintf("[Karma] %s: %d", thing, data[strings.ToLower(thing)]))
+	value, err := karmaGet(strings.ToLower(thing))
+	if err != nil {
+		return err
+	}
+	inv.Reply(fmt.Sprintf("[Karma] %s: %d", thing, value))
 	return nil
 }
@@ -1,40 +1,278 @@
 package main
 
 import (
-	"log"
+	"context"
+	"expvar"
+	"fmt"
+	"runtime/debug"
+	"sync"
 	"time"
 
-	"gopkg.in/sorcix/irc.v2"
-
 	"golang.org/x/sync/errgroup"
 )
 
-type Runner func(*irc.Message) error
+var listenersLog = newLogger("listeners")
+
+// Runner processes a single message. ctx is cancelled once the listener’s
+// timeout has passed, after which listenersRun no longer waits for it.
+type Runner func(ctx context.Context, msg *Message) error
+
+// how long a listener may take per message unless specified otherwise
+const defaultListenerTimeout = 10 * time.Second
+
+// Non-concurrent listeners block the processing of further messages until
+// they finish or time out, so their timeout is capped.
+const maxSequentialTimeout = 2 * time.Second
+
+// Phase determines when a listener runs. All listeners of a phase have
+// finished before any listener of the next phase starts.
+type Phase int
+
+const (
+	// PhaseState is for listeners that track state other listeners rely
+	// on, e.g. channel members.
+	PhaseState Phase = iota
+	// PhaseReact is for listeners that react to messages. This is the
+	// default.
+	PhaseReact
+
+	numPhases
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseState:
+		return "state"
+	case PhaseReact:
+		return "react"
+	}
+	return fmt.Sprintf("Phase(%d)", int(p))
+}
 
 type Listener struct {
-	desc    string
-	created string
-	runner  Runner
+	desc       string
+	created    string
+	runner     Runner
+	phase      Phase
+	concurrent bool
+	timeout    time.Duration
+
+	// counters per listener, published under “listeners” in /debug/vars
+	stats *expvar.Map
+}
+
+var listenerStats = expvar.NewMap("listeners")
+
+type ListenerOption func(*Listener)
+
+// InPhase sets the phase in which the listener runs.
+func InPhase(p Phase) ListenerOption {
+	return func(l *Listener) {
+		l.phase = p
+	}
+}
+
+// Concurrent declares that the listener is safe to run concurrently with the
+// other listeners of its phase. Listeners which may take long, e.g. because
+// they talk to the network, should be concurrent to not delay the others.
+func Concurrent() ListenerOption {
+	return func(l *Listener) {
+		l.concurrent = true
+	}
+}
+
+// Timeout sets how long the listener may take per message, at most
+// maxSequentialTimeout unless the listener is concurrent.
+func Timeout(d time.Duration) ListenerOption {
+	return func(l *Listener) {
+		l.timeout = d
+	}
 }
 
 var listeners []*Listener
 
-func ListenerAdd(desc string, r Runner) {
-	log.Printf("Adding Listener for: %s", desc)
-	listeners = append(listeners, &Listener{
+// listeners disabled at runtime by admins, by desc
+var disabledListeners = struct {
+	mtx sync.RWMutex
+	m   map[string]bool
+}{m: make(map[string]bool)}
+
+// setListenerEnabled enables or disables all listeners called desc until
+// the next restart.
+func setListenerEnabled(desc string, enabled bool) error {
+	found := false
+	for _, l := range listeners {
+		if l.desc == desc {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no listener called %q", desc)
+	}
+	if desc == "commands" && !enabled {
+		// there would be no way to enable it again
+		return fmt.Errorf("the commands listener cannot be disabled")
+	}
+
+	disabledListeners.mtx.Lock()
+	defer disabledListeners.mtx.Unlock()
+	if enabled {
+		delete(disabledListeners.m, desc)
+	} else {
+		disabledListeners.m[desc] = true
+	}
+	return nil
+}
+
+func listenerEnabled(desc string) bool {
+	disabledListeners.mtx.RLock()
+	defer disabledListeners.mtx.RUnlock()
+	return !disabledListeners.m[desc]
+}
+
+// ListenerAdd registers a runner for all incoming messages. Within a phase,
+// non-concurrent listeners run one after another in the order they were
+// added. Runners must return once their context is done, see run.
+func ListenerAdd(desc string, r Runner, opts ...ListenerOption) {
+	listenersLog.Debug("adding listener", "listener", desc)
+	l := &Listener{
 		runner:  r,
 		desc:    desc,
 		created: time.Now().Format("2006-01-02 15:04:05 -0700"),
-	})
+		phase:   PhaseReact,
+		timeout: defaultListenerTimeout,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if !l.concurrent && l.timeout > maxSequentialTimeout {
+		l.timeout = maxSequentialTimeout
+	}
+	// listeners of the same module share their counters
+	if stats, ok := listenerStats.Get(desc).(*expvar.Map); ok {
+		l.stats = stats
+	} else {
+		l.stats = new(expvar.Map).Init()
+		listenerStats.Set(desc, l.stats)
+	}
+	listeners = append(listeners, l)
 }
 
-func listenersRun(msg *irc.Message) error {
-	var wg errgroup.Group
-	for _, l := range listeners {
-		l := l // copy
-		wg.Go(func() error {
-			return l.runner(msg)
-		})
+// run calls the runner with a deadline and turns panics into errors. When the
+// deadline passes, run returns an error without waiting for the runner, so
+// that a stuck listener cannot stall the bot. A runner which ignores the
+// cancellation of its context then keeps running alongside the listeners
+// after it and the next messages; the ordering ListenerAdd describes only
+// holds for runners which finish in time.
+func (l *Listener) run(msg *Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+
+	l.stats.Add("runs", 1)
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				l.stats.Add("panics", 1)
+				listenerFailures.WithLabelValues(l.desc, "panic").Inc()
+				listenersLog.Error("listener panicked", "listener", l.desc, "line", redactLine(msg.String()), "panic", r, "stack", string(debug.Stack()))
+				done <- fmt.Errorf("listener %s panicked: %v", l.desc, r)
+			}
+		}()
+		done <- l.runner(ctx, msg)
+	}()
+
+	select {
+	case err := <-done:
+		l.stats.Add("nanoseconds", int64(time.Since(start)))
+		listenerDuration.WithLabelValues(l.desc).Observe(time.Since(start).Seconds())
+		if err != nil {
+			l.stats.Add("errors", 1)
+			listenerFailures.WithLabelValues(l.desc, "error").Inc()
+			return fmt.Errorf("listener %s: %v", l.desc, err)
+		}
+		return nil
+	case <-ctx.Done():
+		l.stats.Add("timeouts", 1)
+		listenerFailures.WithLabelValues(l.desc, "timeout").Inc()
+		return fmt.Errorf("listener %s did not finish within %v", l.desc, l.timeout)
+	}
+}
+
+// detachedContext keeps the values of a context, but not its cancellation.
+type detachedContext struct{ context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// Spawn runs f in the background, for work a listener or command should not
+// wait for, e.g. fetching something before replying. Like listeners, f is
+// cancelled after timeout and its panics are logged instead of crashing frank.
+// ctx is the context of the listener; f does not get cancelled along with it,
+// as the listener usually returns right away. desc names the work in logs and
+// metrics.
+func Spawn(ctx context.Context, desc string, timeout time.Duration, f func(ctx context.Context)) {
+	ctx, cancel := context.WithTimeout(detachedContext{ctx}, timeout)
+	go func() {
+		defer cancel()
+		defer func() {
+			if r := recover(); r != nil {
+				listenerFailures.WithLabelValues(desc, "panic").Inc()
+				listenersLog.Error("background work panicked", "work", desc, "panic", r, "stack", string(debug.Stack()))
+			}
+		}()
+		start := time.Now()
+		f(ctx)
+		if ctx.Err() == context.DeadlineExceeded {
+			listenerFailures.WithLabelValues(desc, "timeout").Inc()
+			listenersLog.Warn("background work timed out", "work", desc, "timeout", timeout)
+			return
+		}
+		listenerDuration.WithLabelValues(desc).Observe(time.Since(start).Seconds())
+	}()
+}
+
+// listenersRun runs all listeners on msg, phase by phase. Listeners are named
+// after their module and skipped for channels in which the module is
+// disabled, or everywhere if an admin disabled them. The first error
+// encountered is returned, but all listeners run regardless.
+func listenersRun(msg *Message) error {
+	channel := messageChannel(msg)
+	last := numPhases
+	if isIgnored(msg) {
+		// keep track of them, but do not react
+		last = PhaseState + 1
+		listenersLog.Debug("sender is ignored", "prefix", msg.Prefix)
+	}
+	var firstErr error
+	for phase := PhaseState; phase < last; phase++ {
+		var wg errgroup.Group
+		for _, l := range listeners {
+			if l.phase != phase {
+				continue
+			}
+			if !listenerEnabled(l.desc) {
+				continue
+			}
+			if channel != "" && !moduleEnabled(l.desc, channel) {
+				continue
+			}
+			if l.concurrent {
+				l := l // copy
+				wg.Go(func() error {
+					return l.run(msg)
+				})
+				continue
+			}
+			if err := l.run(msg); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if err := wg.Wait(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return wg.Wait()
+	return firstErr
 }
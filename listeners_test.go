@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestListenersRunOrder(t *testing.T) {
+	old := listeners
+	defer func() { listeners = old }()
+	listeners = nil
+
+	var mtx sync.Mutex
+	var order []string
+	record := func(name string, delay time.Duration) Runner {
+		return func(context.Context, *Message) error {
+			time.Sleep(delay)
+			mtx.Lock()
+			defer mtx.Unlock()
+			order = append(order, name)
+			return nil
+		}
+	}
+
+	// registered in an order different from the one they run in
+	ListenerAdd("slow", record("slow", 50*time.Millisecond), Concurrent())
+	ListenerAdd("react1", record("react1", 0))
+	ListenerAdd("state1", record("state1", 10*time.Millisecond), InPhase(PhaseState))
+	ListenerAdd("react2", record("react2", 0))
+	ListenerAdd("state2", record("state2", 0), InPhase(PhaseState))
+
+	if err := listenersRun(parseMessage(":alice!a@host QUIT :bye")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"state1", "state2", "react1", "react2", "slow"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("listeners ran in order %q, want %q", order, want)
+	}
+}
+
+func TestListenersRunIsolation(t *testing.T) {
+	old := listeners
+	defer func() { listeners = old }()
+	listeners = nil
+
+	var mtx sync.Mutex
+	ran := false
+	ListenerAdd("test panic", func(context.Context, *Message) error {
+		panic("boom")
+	})
+	ListenerAdd("test timeout", func(ctx context.Context, _ *Message) error {
+		<-ctx.Done()
+		time.Sleep(time.Second)
+		return nil
+	}, Timeout(10*time.Millisecond))
+	ListenerAdd("test ok", func(context.Context, *Message) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		ran = true
+		return nil
+	})
+
+	start := time.Now()
+	err := listenersRun(parseMessage(":alice!a@host QUIT :bye"))
+	if err == nil {
+		t.Errorf("listenersRun did not return the panic as error")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("listenersRun waited %v for the timed out listener", d)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if !ran {
+		t.Errorf("listener after the panicking one did not run")
+	}
+
+	for desc, counter := range map[string]string{
+		"test panic":   "panics",
+		"test timeout": "timeouts",
+	} {
+		stats := listenerStats.Get(desc).(*expvar.Map)
+		if v, ok := stats.Get(counter).(*expvar.Int); !ok || v.Value() < 1 {
+			t.Errorf("%s: %s counter = %v, want >= 1", desc, counter, stats.Get(counter))
+		}
+	}
+	for desc, kind := range map[string]string{
+		"test panic":   "panic",
+		"test timeout": "timeout",
+	} {
+		if v := testutil.ToFloat64(listenerFailures.WithLabelValues(desc, kind)); v < 1 {
+			t.Errorf("frank_listener_failures_total{listener=%q,kind=%q} = %v, want >= 1", desc, kind, v)
+		}
+	}
+}
+
+func TestSetListenerEnabled(t *testing.T) {
+	old := listeners
+	defer func() { listeners = old }()
+	listeners = nil
+
+	var mtx sync.Mutex
+	runs := 0
+	ListenerAdd("test toggle", func(context.Context, *Message) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		runs++
+		return nil
+	})
+	ListenerAdd("commands", func(context.Context, *Message) error { return nil })
+
+	msg := parseMessage(":alice!a@host QUIT :bye")
+	if err := setListenerEnabled("test toggle", false); err != nil {
+		t.Fatal(err)
+	}
+	listenersRun(msg)
+	if err := setListenerEnabled("test toggle", true); err != nil {
+		t.Fatal(err)
+	}
+	listenersRun(msg)
+	if runs != 1 {
+		t.Errorf("listener ran %d times, want 1 (only while enabled)", runs)
+	}
+
+	if err := setListenerEnabled("nonexistent", false); err == nil {
+		t.Errorf("disabling a nonexistent listener succeeded")
+	}
+	if err := setListenerEnabled("commands", false); err == nil {
+		t.Errorf("disabling the commands listener succeeded")
+	}
+}
+
+func TestSequentialTimeoutCapped(t *testing.T) {
+	old := listeners
+	defer func() { listeners = old }()
+	listeners = nil
+
+	ListenerAdd("test sequential", func(context.Context, *Message) error { return nil }, Timeout(time.Minute))
+	ListenerAdd("test concurrent", func(context.Context, *Message) error { return nil }, Timeout(time.Minute), Concurrent())
+	if got := listeners[0].timeout; got != maxSequentialTimeout {
+		t.Errorf("timeout of a non-concurrent listener = %v, want %v", got, maxSequentialTimeout)
+	}
+	if got := listeners[1].timeout; got != time.Minute {
+		t.Errorf("timeout of a concurrent listener = %v, want %v", got, time.Minute)
+	}
+}
+
+func TestSpawn(t *testing.T) {
+	panics := testutil.ToFloat64(listenerFailures.WithLabelValues("test spawn panic", "panic"))
+	timeouts := testutil.ToFloat64(listenerFailures.WithLabelValues("test spawn", "timeout"))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	Spawn(ctx, "test spawn", 10*time.Millisecond, func(ctx context.Context) {
+		<-ctx.Done()
+		done <- ctx.Err()
+	})
+	// the listener returning does not cancel the work
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("ctx.Err() = %v, want context.DeadlineExceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("spawned work was not cancelled after its timeout")
+	}
+
+	panicked := make(chan struct{})
+	Spawn(context.Background(), "test spawn panic", time.Second, func(context.Context) {
+		close(panicked)
+		panic("boom")
+	})
+	<-panicked
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if testutil.ToFloat64(listenerFailures.WithLabelValues("test spawn panic", "panic")) == panics+1 &&
+			testutil.ToFloat64(listenerFailures.WithLabelValues("test spawn", "timeout")) == timeouts+1 {
+			return
+		}
+	}
+	t.Errorf("panic or timeout of spawned work not counted")
+}
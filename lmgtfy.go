@@ -2,41 +2,45 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
 	"time"
-
-	"gopkg.in/sorcix/irc.v2"
 )
 
-var ErrNoResponse = errors.New("extractPost did not return a response")
-
-func runnerLmgtfy(parsed *irc.Message) error {
-	tgt := Target(parsed)
-	msg := parsed.Trailing()
-
-	if !strings.HasPrefix(tgt, "#") {
-		// only answer to this in channels
-		return nil
-	}
+var lmgtfyModule = &Module{
+	Name:        "lmgtfy",
+	Description: "lets me google that for you",
+}
 
-	reply, err := lmgtfyReplyFor(msg)
-	if err != nil {
-		if err == ErrNoResponse {
+// every search hits Google
+var lmgtfyRateLimit = newRateLimiter("lmgtfy", 3, 5*time.Minute)
+
+var lmgtfyCommand = &Command{
+	Module:   "lmgtfy",
+	Name:     "lmgtfy",
+	Aliases:  []string{"lmgtfy:"},
+	Examples: []string{"lmgtfy golang context", "alice: lmgtfy golang context"},
+	Usage:    "<query>",
+	Help:     "posts the first search result for query",
+	MinArgs:  1,
+	MaxArgs:  1,
+	// only answer to this in channels
+	Channel:   true,
+	NoPrefix:  true,
+	RateLimit: lmgtfyRateLimit,
+	Run: func(inv *Invocation) error {
+		reply, err := lmgtfyReplyFor(inv.Ctx, inv.Args[0])
+		if err != nil {
+			inv.Reply(fmt.Sprintf("Error: %v", err))
 			return nil
 		}
-		Privmsg(tgt, fmt.Sprintf("Error: %v", err))
+		inv.Reply(fmt.Sprintf("[LMGTFY] %s", reply))
 		return nil
-	}
-	Privmsg(tgt, fmt.Sprintf("[LMGTFY] %s", reply))
-
-	return nil
+	},
 }
 
 func googleLucky(ctx context.Context, query string) (*url.URL, error) {
@@ -83,19 +87,8 @@ func googleLucky(ctx context.Context, query string) (*url.URL, error) {
 	return resp.Location()
 }
 
-var lmgtfyMatcher = regexp.MustCompile(`^(?:[\d\pL._-]+: )?lmgtfy:? (.+)`)
-
-func lmgtfyReplyFor(msg string) (string, error) {
-	match := lmgtfyMatcher.FindStringSubmatch(msg)
-	if match == nil {
-		return "", ErrNoResponse
-	}
-	if len(match) < 2 {
-		return "", fmt.Errorf("could not extract lmgtfy query from %q", msg)
-	}
-	query := match[1]
-
-	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+func lmgtfyReplyFor(ctx context.Context, query string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 	u, err := googleLucky(ctx, query)
 	if err != nil {
@@ -104,7 +97,7 @@ func lmgtfyReplyFor(msg string) (string, error) {
 	result := u.String()
 
 	c := &http.Client{Timeout: 10 * time.Second}
-	if title, _, err := TitleGet(c, result); err == nil {
+	if title, _, err := TitleGet(ctx, c, result); err == nil {
 		return fmt.Sprintf("%s @ %s", title, result), nil
 	}
 
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func parseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(l), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// defaultLogModule is the name under which the level of all modules without
+// their own level is configured.
+const defaultLogModule = "default"
+
+// logging holds the log settings shared by all loggers. Levels are looked up
+// on every call, so changes take effect immediately.
+var logging = struct {
+	mtx sync.RWMutex
+	out io.Writer
+	// json selects JSON lines instead of logfmt
+	json         bool
+	defaultLevel Level
+	// module → level, for modules whose level differs from the default
+	levels map[string]Level
+	// all modules which have a logger
+	modules map[string]bool
+	// now is replaced in tests.
+	now func() time.Time
+}{
+	out:          os.Stderr,
+	defaultLevel: LevelInfo,
+	levels:       make(map[string]Level),
+	modules:      make(map[string]bool),
+	now:          time.Now,
+}
+
+// Logger writes structured log entries for one module, e.g. urifind. Every
+// entry has a message and optionally key/value pairs:
+//
+//	urifindLog.Info("posting title", "url", url, "title", title)
+type Logger struct {
+	module string
+}
+
+// newLogger returns the logger for module. Loggers are meant to be created
+// once per module, as package level variables.
+func newLogger(module string) *Logger {
+	logging.mtx.Lock()
+	defer logging.mtx.Unlock()
+	logging.modules[module] = true
+	return &Logger{module: module}
+}
+
+// Enabled reports whether entries of level are logged, which is useful to
+// skip expensive debug output.
+func (l *Logger) Enabled(level Level) bool {
+	logging.mtx.RLock()
+	defer logging.mtx.RUnlock()
+	min, ok := logging.levels[l.module]
+	if !ok {
+		min = logging.defaultLevel
+	}
+	return level >= min
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(LevelInfo, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(LevelWarn, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+// Fatal logs an error and exits.
+func (l *Logger) Fatal(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	if len(keyvals)%2 != 0 {
+		keyvals = append(keyvals, "(MISSING)")
+	}
+	fields := []string{
+		"time", logging.now().Format("2006-01-02T15:04:05.000Z07:00"),
+		"level", level.String(),
+		"module", l.module,
+		"msg", msg,
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		fields = append(fields, fmt.Sprint(keyvals[i]), logValue(keyvals[i+1]))
+	}
+
+	var buf bytes.Buffer
+	logging.mtx.RLock()
+	asJSON := logging.json
+	logging.mtx.RUnlock()
+	if asJSON {
+		buf.WriteByte('{')
+		for i := 0; i < len(fields); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			k, _ := json.Marshal(fields[i])
+			v, _ := json.Marshal(fields[i+1])
+			buf.Write(k)
+			buf.WriteByte(':')
+			buf.Write(v)
+		}
+		buf.WriteByte('}')
+	} else {
+		for i := 0; i < len(fields); i += 2 {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(fields[i] + "=" + logfmtValue(fields[i+1]))
+		}
+	}
+	buf.WriteByte('\n')
+
+	// one Write per entry keeps concurrent entries apart
+	logging.mtx.Lock()
+	defer logging.mtx.Unlock()
+	logging.out.Write(buf.Bytes())
+}
+
+func logValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case error:
+		if v == nil {
+			return "<nil>"
+		}
+		return v.Error()
+	case time.Duration:
+		return v.Round(time.Millisecond).String()
+	}
+	return fmt.Sprint(v)
+}
+
+// logfmtValue quotes v if necessary to keep key=value pairs apart.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \"=") || strings.IndexFunc(v, unicode.IsControl) != -1 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// stdlibLog is used for output of the log package, e.g. from libraries.
+var stdlibLog = newLogger("log")
+
+type stdlibWriter struct{}
+
+func (stdlibWriter) Write(p []byte) (int, error) {
+	stdlibLog.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// setupLogging routes the log package through stdlibLog and applies the
+// log settings from the config.
+func setupLogging(c *Config) {
+	log.SetFlags(0)
+	log.SetOutput(stdlibWriter{})
+	applyLogConfig(c)
+}
+
+// applyLogConfig replaces the log format and all levels with those from the
+// config, dropping levels set at runtime.
+func applyLogConfig(c *Config) {
+	logging.mtx.Lock()
+	defer logging.mtx.Unlock()
+	logging.json = c.Log.Format == "json"
+	logging.defaultLevel = LevelInfo
+	if c.Verbose {
+		logging.defaultLevel = LevelDebug
+	}
+	logging.levels = make(map[string]Level)
+	for module, name := range c.Log.Levels {
+		// validated with the config
+		level, _ := parseLevel(name)
+		if module == defaultLogModule {
+			logging.defaultLevel = level
+		} else {
+			logging.levels[module] = level
+		}
+	}
+}
+
+// setLogLevel changes the level of module, or of all modules without their
+// own level for defaultLogModule.
+func setLogLevel(module string, level Level) error {
+	logging.mtx.Lock()
+	defer logging.mtx.Unlock()
+	if module == defaultLogModule {
+		logging.defaultLevel = level
+		return nil
+	}
+	if !logging.modules[module] {
+		return fmt.Errorf("unknown log module %q", module)
+	}
+	logging.levels[module] = level
+	return nil
+}
+
+// logLevels returns the level of every module and defaultLogModule.
+func logLevels() map[string]string {
+	logging.mtx.RLock()
+	defer logging.mtx.RUnlock()
+	levels := map[string]string{defaultLogModule: logging.defaultLevel.String()}
+	for module := range logging.modules {
+		level, ok := logging.levels[module]
+		if !ok {
+			level = logging.defaultLevel
+		}
+		levels[module] = level.String()
+	}
+	return levels
+}
+
+// validateLogConfig checks the log section of the config.
+func validateLogConfig(lc LogConfig) error {
+	switch lc.Format {
+	case "", "logfmt", "json":
+	default:
+		return fmt.Errorf("log.format must be \"logfmt\" or \"json\", not %q", lc.Format)
+	}
+	logging.mtx.RLock()
+	defer logging.mtx.RUnlock()
+	for module, name := range lc.Levels {
+		if module != defaultLogModule && !logging.modules[module] {
+			return fmt.Errorf("log.levels: unknown module %q", module)
+		}
+		if _, err := parseLevel(name); err != nil {
+			return fmt.Errorf("log.levels: %s: %v", module, err)
+		}
+	}
+	return nil
+}
+
+// logLevelLines describes the levels for the loglevel command: modules with
+// the default level are only listed by name.
+func logLevelLines() []string {
+	levels := logLevels()
+	def := levels[defaultLogModule]
+	var own, others []string
+	for module, level := range levels {
+		if module == defaultLogModule {
+			continue
+		}
+		if level == def {
+			others = append(others, module)
+		} else {
+			own = append(own, module+"="+level)
+		}
+	}
+	sort.Strings(own)
+	sort.Strings(others)
+	lines := []string{"default level: " + def}
+	if len(own) > 0 {
+		lines = append(lines, "own levels: "+strings.Join(own, " "))
+	}
+	return append(lines, "other modules: "+strings.Join(others, " "))
+}
+
+var logLevelCommand = &Command{
+	Module:   "admin",
+	Name:     "loglevel",
+	Usage:    "[<module> <level>]",
+	Help:     "shows or changes (until the next reload) the log level of a module or the default",
+	Examples: []string{"loglevel", "loglevel urifind debug", "loglevel default warn"},
+	MaxArgs:  2,
+	Query:    true,
+	Role:     RoleOperator,
+	Run: func(inv *Invocation) error {
+		if len(inv.Args) == 0 {
+			for _, line := range logLevelLines() {
+				inv.Reply(line)
+			}
+			return nil
+		}
+		if len(inv.Args) != 2 {
+			inv.Reply("usage: loglevel <module> <level>")
+			return nil
+		}
+		level, err := parseLevel(inv.Args[1])
+		if err == nil {
+			err = setLogLevel(inv.Args[0], level)
+		}
+		if err != nil {
+			inv.Reply(err.Error())
+			return nil
+		}
+		inv.Reply(fmt.Sprintf("%s now logs at %s", inv.Args[0], level))
+		return nil
+	},
+}
+
+// serveLogLevels shows the log levels as JSON, and changes the level of the
+// module given in a POST request, e.g. module=urifind&level=debug.
+func serveLogLevels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		level, err := parseLevel(r.FormValue("level"))
+		if err == nil {
+			err = setLogLevel(r.FormValue("module"), level)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mainLog.Info("log level changed via HTTP", "module", r.FormValue("module"), "level", level, "remote", r.RemoteAddr)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(logLevels()); err != nil {
+		mainLog.Warn("could not write log levels", "err", err)
+	}
+}
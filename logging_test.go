@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog redirects all log output into the returned buffer and stops
+// the clock, until restore is called.
+func captureLog() (buf *bytes.Buffer, restore func()) {
+	buf = new(bytes.Buffer)
+	logging.mtx.Lock()
+	defer logging.mtx.Unlock()
+	oldOut, oldNow := logging.out, logging.now
+	oldJSON, oldDefault, oldLevels := logging.json, logging.defaultLevel, logging.levels
+	logging.out = buf
+	logging.now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+	logging.json, logging.defaultLevel, logging.levels = false, LevelInfo, make(map[string]Level)
+	return buf, func() {
+		logging.mtx.Lock()
+		defer logging.mtx.Unlock()
+		logging.out, logging.now = oldOut, oldNow
+		logging.json, logging.defaultLevel, logging.levels = oldJSON, oldDefault, oldLevels
+	}
+}
+
+func TestLogger(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+
+	l := newLogger("test")
+	other := newLogger("test-other")
+	l.Info("posting title", "url", "https://example.net/", "title", `say "hi"`, "n", 3)
+	l.Debug("hidden")
+	other.Warn("odd", "key")
+	want := `time=2020-01-02T03:04:05.000Z level=info module=test msg="posting title" url=https://example.net/ title="say \"hi\"" n=3
+time=2020-01-02T03:04:05.000Z level=warn module=test-other msg=odd key=(MISSING)
+`
+	if got := buf.String(); got != want {
+		t.Errorf("logged:\n%s\nwant:\n%s", got, want)
+	}
+
+	// debug for one module only
+	buf.Reset()
+	if err := setLogLevel("test", LevelDebug); err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("shown")
+	other.Debug("hidden")
+	if got := buf.String(); !strings.Contains(got, "msg=shown") || strings.Contains(got, "hidden") {
+		t.Errorf("logged %q, want only the debug entry of test", got)
+	}
+	if err := setLogLevel("nonexistent", LevelDebug); err == nil {
+		t.Errorf("setLogLevel succeeded for an unknown module")
+	}
+
+	buf.Reset()
+	c := defaultConfig()
+	c.Log = LogConfig{Format: "json", Levels: map[string]string{"default": "error", "test-other": "debug"}}
+	applyLogConfig(c)
+	l.Warn("hidden")
+	other.Debug("shown", "err", errors.New("test error"))
+	var entry map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%q: %v", buf, err)
+	}
+	if entry["module"] != "test-other" || entry["level"] != "debug" || entry["msg"] != "shown" || entry["err"] != "test error" {
+		t.Errorf("logged %q", buf)
+	}
+}
+
+func TestLogConfig(t *testing.T) {
+	for _, lc := range []LogConfig{
+		{Format: "xml"},
+		{Levels: map[string]string{"urifind": "verbose"}},
+		{Levels: map[string]string{"nonexistent": "debug"}},
+	} {
+		if err := validateLogConfig(lc); err == nil {
+			t.Errorf("validateLogConfig(%+v) succeeded", lc)
+		}
+	}
+	if err := validateLogConfig(LogConfig{Format: "json", Levels: map[string]string{"default": "WARN", "urifind": "debug"}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeLogLevels(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+
+	rec := httptest.NewRecorder()
+	body := url.Values{"module": {"urifind"}, "level": {"debug"}}.Encode()
+	req := httptest.NewRequest("POST", "/debug/log", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	serveLogLevels(rec, req)
+	var levels map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &levels); err != nil {
+		t.Fatalf("%s: %v", rec.Body, err)
+	}
+	if levels["urifind"] != "debug" || levels["rss"] != "info" || levels["default"] != "info" {
+		t.Errorf("levels after POST = %v", levels)
+	}
+
+	rec = httptest.NewRecorder()
+	serveLogLevels(rec, httptest.NewRequest("POST", "/debug/log?module=urifind&level=loud", nil))
+	if rec.Code != 400 {
+		t.Errorf("POST with an invalid level: status %d, want 400", rec.Code)
+	}
+}
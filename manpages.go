@@ -1,54 +1,102 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 
 	"gopkg.in/sorcix/irc.v2"
 )
 
+var manpagesLog = newLogger("manpages")
+
 // manpagesMatcher finds words of the form "name(section)", where section is
 // either a number, or a number followed by some characters. See tests for a
 // list of examples.
 var manpagesMatcher = regexp.MustCompile(`\b([\w-]+)\((\d[\da-z_-]*)\)(\W|$)`)
 
-func runnerManpages(parsed *irc.Message) error {
-	for _, l := range extractManpages(parsed.Trailing()) {
+var manpagesModule = &Module{
+	Name:        "manpages",
+	Description: "links to manpages mentioned like ls(1)",
+}
+
+// shared by the man command and manpages mentioned in messages, as both
+// look up the manpages
+var manpagesRateLimit = newRateLimiter("manpages", 5, time.Minute)
+
+var manCommand = &Command{
+	Module:    "manpages",
+	Name:      "man",
+	Examples:  []string{"man ls", "man 1 ls", "man bullseye 1 ls"},
+	Usage:     "[suite] [section] <page>",
+	Help:      "links to the Debian manpage",
+	MinArgs:   1,
+	Channel:   true,
+	Query:     true,
+	RateLimit: manpagesRateLimit,
+	Run: func(inv *Invocation) error {
+		link := manpageLink(inv.Args)
+		Spawn(inv.Ctx, "manpages check", 10*time.Second, func(ctx context.Context) {
+			replyManpage(ctx, inv.Reply, link)
+		})
+		return nil
+	},
+}
+
+func runnerManpages(ctx context.Context, parsed *Message) error {
+	if parsed.Command != irc.PRIVMSG {
+		return nil
+	}
+	reply := func(msg string) { Privmsg(Target(parsed), msg) }
+	if IsPrivateQuery(parsed) {
+		reply = func(msg string) { Privmsg(Nick(parsed), msg) }
+	}
+	links := extractManpages(parsed.Trailing())
+	if len(links) == 0 || !manpagesRateLimit.Allow(parsed, messageChannel(parsed)) {
+		return nil
+	}
+	for _, l := range links {
 		l := l // copy
-		go func() {
-			req, err := http.NewRequest("HEAD", l, nil)
-			if err != nil {
-				log.Printf("manpage: %v", err)
-				return
-			}
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				log.Printf("manpage: %s: %v", l, err)
-				return
-			}
-			// for keepalive
-			ioutil.ReadAll(resp.Body)
-			resp.Body.Close()
-			if got, want := resp.StatusCode, http.StatusOK; got != want {
-				log.Printf("manpage: not replying: %s: unexpected HTTP status code: got %d, want %d", l, got, want)
-				return
-			}
-			Privmsg(Target(parsed), "[manpage] "+l)
-		}()
+		Spawn(ctx, "manpages check", 10*time.Second, func(ctx context.Context) {
+			replyManpage(ctx, reply, l)
+		})
 	}
 	return nil
 }
 
-func extractManpages(msg string) (links []string) {
-	const prefix = "frank: man "
-	if strings.HasPrefix(msg, prefix) {
-		return []string{fmt.Sprintf("https://manpages.debian.org/%s", strings.Replace(msg[len(prefix):], " ", "/", -1))}
+// replyManpage replies with the link, unless it does not exist.
+func replyManpage(ctx context.Context, reply func(string), l string) {
+	req, err := http.NewRequest("HEAD", l, nil)
+	if err != nil {
+		manpagesLog.Warn("could not create request", "err", err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		manpagesLog.Warn("could not check manpage", "url", l, "err", err)
+		return
+	}
+	// for keepalive
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		manpagesLog.Info("not replying, unexpected HTTP status code", "url", l, "got", got, "want", want)
+		return
 	}
+	reply("[manpage] " + l)
+}
+
+// manpageLink returns the link for the arguments of the man command, e.g.
+// “bullseye 1 ls” → https://manpages.debian.org/bullseye/1/ls
+func manpageLink(args []string) string {
+	return fmt.Sprintf("https://manpages.debian.org/%s", strings.Join(args, "/"))
+}
 
+func extractManpages(msg string) (links []string) {
 	ms := manpagesMatcher.FindAllStringSubmatch(msg, -1)
 	for _, m := range ms {
 		links = append(links, fmt.Sprintf("https://manpages.debian.org/%s.%s", m[1], m[2]))
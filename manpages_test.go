@@ -19,7 +19,6 @@ func TestManpageExtract(t *testing.T) {
 		{"das kann man in foo(3pl) nachlesen", []string{"https://manpages.debian.org/foo.3pl"}},
 		{"das kann man in foo(1) oder bar(3) nachlesen", []string{"https://manpages.debian.org/foo.1", "https://manpages.debian.org/bar.3"}},
 		{"man foo", nil},
-		{"frank: man foo", []string{"https://manpages.debian.org/foo"}},
 		{"git-rebase(1)", []string{"https://manpages.debian.org/git-rebase.1"}},
 	}
 
@@ -33,3 +32,20 @@ func TestManpageExtract(t *testing.T) {
 		}
 	}
 }
+
+func TestManpageLink(t *testing.T) {
+	tcs := []struct {
+		Args   []string
+		Expect string
+	}{
+		{[]string{"foo"}, "https://manpages.debian.org/foo"},
+		{[]string{"1", "foo"}, "https://manpages.debian.org/1/foo"},
+		{[]string{"bullseye", "1", "foo"}, "https://manpages.debian.org/bullseye/1/foo"},
+	}
+
+	for _, tc := range tcs {
+		if got := manpageLink(tc.Args); got != tc.Expect {
+			t.Errorf("manpageLink(%q) = %q, expected %q", tc.Args, got, tc.Expect)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Message is a message received from the server, along with its IRCv3 message
+// tags, which irc.Message does not support.
+type Message struct {
+	*irc.Message
+	// Tags are the unescaped message tags, e.g. "account" (account-tag) or
+	// "time" (server-time). Tags without a value map to "".
+	Tags map[string]string
+	// Time is when the server processed the message if server-time is
+	// enabled, otherwise when it was parsed.
+	Time time.Time
+}
+
+// parseMessage parses a raw IRC line, which may start with message tags. It
+// returns nil if the line could not be parsed.
+func parseMessage(raw string) *Message {
+	m := &Message{Time: time.Now()}
+	if strings.HasPrefix(raw, "@") {
+		idx := strings.IndexByte(raw, ' ')
+		if idx == -1 {
+			return nil
+		}
+		m.Tags = parseTags(raw[1:idx])
+		raw = strings.TrimLeft(raw[idx:], " ")
+	}
+	m.Message = irc.ParseMessage(raw)
+	if m.Message == nil {
+		return nil
+	}
+	if t, ok := m.Tags["time"]; ok {
+		if parsed, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			m.Time = parsed
+		}
+	}
+	return m
+}
+
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 1 {
+			tags[kv[0]] = ""
+			continue
+		}
+		tags[kv[0]] = unescapeTagValue(kv[1])
+	}
+	return tags
+}
+
+// unescapeTagValue reverses the escaping of tag values, see
+// https://ircv3.net/specs/extensions/message-tags#escaping-values
+func unescapeTagValue(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			// a trailing backslash is dropped
+			break
+		}
+		switch s[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// Tag returns the value of the message tag key.
+func (m *Message) Tag(key string) (value string, ok bool) {
+	value, ok = m.Tags[key]
+	return value, ok
+}
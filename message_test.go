@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseMessage(t *testing.T) {
+	msg := parseMessage(`@time=2021-05-01T12:00:00.123Z;account=xeen;+example.com/flag;msgid=a\:b\sc\\d\ :xeen!x@example.net PRIVMSG #chaos-hd :hi there`)
+	if msg == nil {
+		t.Fatal("could not parse message with tags")
+	}
+	want := map[string]string{
+		"time":              "2021-05-01T12:00:00.123Z",
+		"account":           "xeen",
+		"+example.com/flag": "",
+		"msgid":             `a;b c\d`,
+	}
+	if !reflect.DeepEqual(msg.Tags, want) {
+		t.Errorf("Tags = %q, want %q", msg.Tags, want)
+	}
+	if want := time.Date(2021, 5, 1, 12, 0, 0, 123e6, time.UTC); !msg.Time.Equal(want) {
+		t.Errorf("Time = %v, want %v", msg.Time, want)
+	}
+	if Nick(msg) != "xeen" || msg.Command != "PRIVMSG" || Target(msg) != "#chaos-hd" || msg.Trailing() != "hi there" {
+		t.Errorf("parsed %#v", msg.Message)
+	}
+	if account, ok := msg.Tag("account"); !ok || account != "xeen" {
+		t.Errorf(`Tag("account") = %q, %v`, account, ok)
+	}
+
+	msg = parseMessage(":irc.example.net NOTICE * :hello")
+	if msg == nil || msg.Tags != nil || time.Since(msg.Time) > time.Minute {
+		t.Errorf("message without tags parsed as %+v", msg)
+	}
+
+	for _, invalid := range []string{"", "@tags-only"} {
+		if msg := parseMessage(invalid); msg != nil {
+			t.Errorf("parseMessage(%q) = %+v, want nil", invalid, msg)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served at /metrics if listen_http is set.
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "frank_messages_received_total",
+		Help: "IRC messages received, by command.",
+	}, []string{"command"})
+
+	messagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "frank_messages_sent_total",
+		Help: "IRC messages sent, by command.",
+	}, []string{"command"})
+
+	listenerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "frank_listener_duration_seconds",
+		Help:    "How long listeners took per message, excluding timeouts.",
+		Buckets: []float64{.0001, .001, .01, .1, .5, 1, 5, 10},
+	}, []string{"listener"})
+
+	// kind is "error", "timeout" or "panic"; panics are errors, too.
+	listenerFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "frank_listener_failures_total",
+		Help: "Listener runs which failed, by kind of failure.",
+	}, []string{"listener", "kind"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "frank_outbound_queue_lines",
+		Help: "Lines waiting in the outbound queue.",
+	}, func() float64 { return float64(outbound.Len()) })
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "frank_connected",
+		Help: "Whether frank is connected (1) or not (0).",
+	}, func() float64 {
+		if currentTransport() == nil {
+			return 0
+		}
+		return 1
+	})
+
+	reconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "frank_reconnects_total",
+		Help: "Reconnects after the connection (e.g. the RobustIRC session) was lost.",
+	})
+
+	// domain is one of urifind.metrics_domains, "other" or "invalid"; outcome is
+	// "ok", "pointless" (a title which is not posted), "no_title" or "error".
+	titleFetches = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "frank_title_fetch_duration_seconds",
+		Help:    "How long fetching the title of a link took, by domain and outcome.",
+		Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"domain", "outcome"})
+
+	// result is "ok" or "error"
+	rssPolls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "frank_rss_polls_total",
+		Help: "RSS feed polls, by feed and result.",
+	}, []string{"feed", "result"})
+
+	rssItemsPosted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "frank_rss_items_posted_total",
+		Help: "RSS items posted, by feed.",
+	}, []string{"feed"})
+
+	karmaVotes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "frank_karma_votes_total",
+		Help: "Karma votes, by operator (++ or --).",
+	}, []string{"operator"})
+
+	greetingsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "frank_greetings_sent_total",
+		Help: "Greetings sent to new users, by channel.",
+	}, []string{"channel"})
+)
+
+// lineCommand returns the command of a line frank sends, e.g. PRIVMSG.
+func lineCommand(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// metricsDomain returns the label for the domain of rawurl in the title fetch
+// metrics: one of urifind.metrics_domains, “other” or “invalid”.
+func metricsDomain(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Hostname() == "" {
+		return "invalid"
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range currentConfig().Urifind.MetricsDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return domain
+		}
+	}
+	return "other"
+}
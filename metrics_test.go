@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestLineCommand(t *testing.T) {
+	for line, want := range map[string]string{
+		"PRIVMSG #test :hi":  "PRIVMSG",
+		"privmsg #test :hi":  "PRIVMSG",
+		"JOIN #test":         "JOIN",
+		"":                   "unknown",
+		"AUTHENTICATE PLAIN": "AUTHENTICATE",
+	} {
+		if got := lineCommand(line); got != want {
+			t.Errorf("lineCommand(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestMetricsDomain(t *testing.T) {
+	for url, want := range map[string]string{
+		"https://www.GitHub.com/nnev/frank":   "github.com",
+		"http://github.com:8080/":             "github.com",
+		"https://de.wikipedia.org/wiki/Chaos": "wikipedia.org",
+		"https://noname-ev.de":                "noname-ev.de",
+		"https://example.net/foo":             "other",
+		"https://notgithub.com/":              "other",
+		"http://":                             "invalid",
+	} {
+		if got := metricsDomain(url); got != want {
+			t.Errorf("metricsDomain(%q) = %q, want %q", url, got, want)
+		}
+	}
+
+	c := defaultConfig()
+	c.Urifind.MetricsDomains = []string{"example.net"}
+	withConfig(t, mustValidate(c))
+	for url, want := range map[string]string{
+		"https://example.net/foo": "example.net",
+		"https://github.com/":     "other",
+	} {
+		if got := metricsDomain(url); got != want {
+			t.Errorf("with metrics_domains [example.net]: metricsDomain(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	karmaVotes.WithLabelValues("++").Inc()
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"frank_outbound_queue_lines ",
+		"frank_connected 0",
+		`frank_karma_votes_total{operator="++"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics does not contain %q", want)
+		}
+	}
+}
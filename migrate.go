@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bookkeeping of the store itself
+const metaNamespace = "meta"
+
+// the key in metaNamespace marking a gob file as imported is migratedPrefix
+// followed by its name
+const migratedPrefix = "migrated/"
+
+// gob files written by earlier versions, which are imported into the store
+// once and then renamed to <file>.migrated.
+var gobMigrations = []struct {
+	file    string
+	migrate func(tx Tx, r io.Reader) error
+}{
+	{"karma", migrateKarma},
+	{"last-seen", migrateLastSeen},
+}
+
+func migrateKarma(tx Tx, r io.Reader) error {
+	var m map[string]int
+	if err := gob.NewDecoder(r).Decode(&m); err != nil {
+		return err
+	}
+	for thing, karma := range m {
+		if err := putJSON(tx, karmaNamespace, thing, karma); err != nil {
+			return err
+		}
+	}
+	stateLog.Info("migrated karma", "things", len(m))
+	return nil
+}
+
+func migrateLastSeen(tx Tx, r io.Reader) error {
+	var m map[string]map[string]time.Time
+	if err := gob.NewDecoder(r).Decode(&m); err != nil {
+		return err
+	}
+	// Earlier versions did not fold channels and nicks like touchUser does
+	// now, so several entries may end up under the same key.
+	folded := make(map[string]time.Time)
+	for channel, c := range m {
+		for name, last := range c {
+			key := lastSeenKey(fold(channel), foldLastSeenName(name))
+			if last.After(folded[key]) {
+				folded[key] = last
+			}
+		}
+	}
+	for key, last := range folded {
+		if err := putJSON(tx, lastSeenNamespace, key, last); err != nil {
+			return err
+		}
+	}
+	stateLog.Info("migrated last-seen", "entries", len(folded))
+	return nil
+}
+
+// foldLastSeenName folds nicks, but keeps hostnames, which are stored
+// alongside them, as they are. Unlike nicks, hostnames contain “.”, “/”
+// or “:”.
+func foldLastSeenName(name string) string {
+	if strings.ContainsAny(name, "./:") {
+		return name
+	}
+	return fold(name)
+}
+
+// migrateGobFiles imports the gob files in dir into s, unless that has
+// already been done.
+func migrateGobFiles(s Store, dir string) error {
+	for _, m := range gobMigrations {
+		path := filepath.Join(dir, m.file)
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		marker := migratedPrefix + m.file
+		err = s.Update(func(tx Tx) error {
+			if tx.Get(metaNamespace, marker) != nil {
+				stateLog.Info("already migrated, ignoring", "path", path)
+				return nil
+			}
+			if err := m.migrate(tx, f); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			return putJSON(tx, metaNamespace, marker, time.Now())
+		})
+		f.Close()
+		if err != nil {
+			return err
+		}
+		// Keep the old file around as a backup, but out of the way.
+		if err := os.Rename(path, path+".migrated"); err != nil {
+			stateLog.Warn("could not rename after migrating", "path", path, "err", err)
+		}
+	}
+	return nil
+}
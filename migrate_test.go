@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrateGobFiles(t *testing.T) {
+	dir := t.TempDir()
+	seen := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]interface{}{
+		"karma": map[string]int{"frank": 10000, "go": -3},
+		"last-seen": map[string]map[string]time.Time{
+			"#chaos-hd": {"alice": seen, "Example.NET": seen},
+			"#Chaos-HD": {"Alice": seen.Add(-time.Hour)},
+		},
+	}
+	for name, data := range files {
+		err := writeAtomically(filepath.Join(dir, name), func(w io.Writer) error {
+			return gob.NewEncoder(w).Encode(data)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newMemoryStore()
+	if err := migrateGobFiles(s, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not moved out of the way: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name+".migrated")); err != nil {
+			t.Errorf("backup of %s missing: %v", name, err)
+		}
+	}
+
+	check := func(wantKarma int) {
+		t.Helper()
+		err := s.View(func(tx Tx) error {
+			var k int
+			if _, err := getJSON(tx, karmaNamespace, "go", &k); err != nil || k != wantKarma {
+				t.Errorf("karma of go = %d, %v, want %d", k, err, wantKarma)
+			}
+			var last time.Time
+			if _, err := getJSON(tx, lastSeenNamespace, lastSeenKey("#chaos-hd", "alice"), &last); err != nil || !last.Equal(seen) {
+				t.Errorf("alice last seen %v, %v, want %v", last, err, seen)
+			}
+			// hostnames are not folded, see touchUser
+			if ok, err := getJSON(tx, lastSeenNamespace, lastSeenKey("#chaos-hd", "Example.NET"), &last); err != nil || !ok {
+				t.Errorf("hostname last seen missing: %v", err)
+			}
+			var keys int
+			tx.ForEach(lastSeenNamespace, func(string, []byte) error {
+				keys++
+				return nil
+			})
+			if keys != 2 {
+				t.Errorf("migrated %d last-seen entries, want 2", keys)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(-3)
+
+	// Restoring the old file must not import it again, which would undo the
+	// votes since.
+	if err := os.Rename(filepath.Join(dir, "karma.migrated"), filepath.Join(dir, "karma")); err != nil {
+		t.Fatal(err)
+	}
+	err := s.Update(func(tx Tx) error {
+		return putJSON(tx, karmaNamespace, "go", 5)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateGobFiles(s, dir); err != nil {
+		t.Fatal(err)
+	}
+	check(5)
+}
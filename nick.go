@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// how often to try getting the wanted nick back while using another one
+const nickReclaimInterval = 5 * time.Minute
+
+// how long to give NickServ for REGAIN, or for disconnecting the other
+// session after GHOST. NICK is queued before PRIVMSG, so it cannot simply be
+// sent after GHOST.
+const ghostDelay = 5 * time.Second
+
+// fallback nicks append up to this many underscores before using digits
+const maxNickUnderscores = 3
+
+// ERR_UNAVAILRESOURCE is sent by some servers for nicks which are
+// temporarily blocked, e.g. after a netsplit.
+const ERR_UNAVAILRESOURCE = "437"
+
+// self tracks the nick frank actually has, which differs from the wanted one
+// while the latter is in use by somebody else.
+var self = struct {
+	mtx sync.Mutex
+	// nick is empty until the server has accepted us.
+	nick string
+	// wanted is the nick from the config or set by the nick command, until
+	// the next restart or config change.
+	wanted string
+	// reclaiming is set while the reclaim timer runs.
+	reclaiming bool
+	// timers are the pending regain and reclaim timers of this connection,
+	// see afterLocked.
+	timers     map[*time.Timer]bool
+	generation int
+}{timers: make(map[*time.Timer]bool)}
+
+// currentNick returns the nick frank has on the server. Use it instead of the
+// configured nick whenever checking if something is about frank.
+func currentNick() string {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	if self.nick != "" {
+		return self.nick
+	}
+	return wantedNickLocked()
+}
+
+// wantedNick returns the nick frank tries to have.
+func wantedNick() string {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	return wantedNickLocked()
+}
+
+func wantedNickLocked() string {
+	if self.wanted != "" {
+		return self.wanted
+	}
+	return currentConfig().Nick
+}
+
+// isMe reports whether nick is frank’s current nick.
+func isMe(nick string) bool {
+	return equalFold(nick, currentNick())
+}
+
+// setWantedNick makes frank change its nick until the next restart.
+func setWantedNick(nick string) {
+	self.mtx.Lock()
+	self.wanted = nick
+	self.mtx.Unlock()
+	Post("NICK " + nick)
+}
+
+// resetNick forgets the nick of the last connection and stops trying to
+// regain the wanted one.
+func resetNick() {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.nick = ""
+	self.reclaiming = false
+	self.generation++
+	for t := range self.timers {
+		t.Stop()
+		delete(self.timers, t)
+	}
+}
+
+// afterLocked calls f after d, unless resetNick is called in the meantime.
+// self.mtx must be held.
+func afterLocked(d time.Duration, f func()) {
+	generation := self.generation
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		self.mtx.Lock()
+		current := generation == self.generation
+		delete(self.timers, t)
+		self.mtx.Unlock()
+		if current {
+			f()
+		}
+	})
+	self.timers[t] = true
+}
+
+// fallbackNick returns the nick to try after inUse was rejected while
+// registering, e.g. frank → frank_ → frank__ → frank___ → frank123.
+func fallbackNick(wanted, inUse string) string {
+	next := wanted + strconv.Itoa(100+rand.Intn(900))
+	if strings.HasPrefix(inUse, wanted) {
+		suffix := strings.TrimPrefix(inUse, wanted)
+		if strings.Trim(suffix, "_") == "" && len(suffix) < maxNickUnderscores {
+			next = inUse + "_"
+		}
+	}
+	if max := maxNickLen(); max > 0 && len(next) > max {
+		// replace the end of the nick instead
+		suffix := strings.TrimPrefix(next, wanted)
+		if len(suffix) >= max {
+			return next[:max]
+		}
+		next = wanted[:max-len(suffix)] + suffix
+	}
+	return next
+}
+
+// regainNick tries to get the wanted nick back. With a NickServ password,
+// NickServ is asked to REGAIN it for us. Services which do not support that
+// are asked to disconnect the other session (GHOST) instead, before taking
+// the nick ourselves, waiting delay (usually ghostDelay) after each step.
+func regainNick(delay time.Duration) {
+	wanted := wantedNick()
+	password := currentConfig().NickservPassword
+	if password == "" {
+		Post("NICK " + wanted)
+		return
+	}
+	ircLog.Info("asking NickServ to regain the nick", "nick", wanted)
+	Privmsg("NickServ", "REGAIN "+wanted+" "+password)
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	afterLocked(delay, func() {
+		if isMe(wanted) {
+			return
+		}
+		ircLog.Info("REGAIN did not work, asking NickServ to disconnect whoever uses the nick", "nick", wanted)
+		Privmsg("NickServ", "GHOST "+wanted+" "+password)
+		self.mtx.Lock()
+		defer self.mtx.Unlock()
+		afterLocked(delay, func() {
+			if !isMe(wanted) {
+				Post("NICK " + wanted)
+			}
+		})
+	})
+}
+
+// scheduleReclaim regularly tries to get the wanted nick back, until frank
+// has it.
+func scheduleReclaim() {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	if self.reclaiming {
+		return
+	}
+	self.reclaiming = true
+	var reclaim func()
+	reclaim = func() {
+		self.mtx.Lock()
+		if self.nick == "" || equalFold(self.nick, wantedNickLocked()) {
+			// have it, or not connected: boot() asks for it again
+			self.reclaiming = false
+			self.mtx.Unlock()
+			return
+		}
+		self.mtx.Unlock()
+		ircLog.Info("trying to reclaim nick", "nick", wantedNick())
+		regainNick(ghostDelay)
+		self.mtx.Lock()
+		defer self.mtx.Unlock()
+		afterLocked(nickReclaimInterval, reclaim)
+	}
+	afterLocked(nickReclaimInterval, reclaim)
+}
+
+// runnerNick keeps track of frank’s nick and falls back to another one while
+// the wanted nick is in use.
+func runnerNick(ctx context.Context, parsed *Message) error {
+	switch parsed.Command {
+	case irc.RPL_WELCOME:
+		nick := parsed.Param(0)
+		self.mtx.Lock()
+		self.nick = nick
+		have := equalFold(nick, wantedNickLocked())
+		self.mtx.Unlock()
+		ircLog.Info("registered", "nick", nick)
+		if !have {
+			regainNick(ghostDelay)
+			scheduleReclaim()
+		}
+
+	case irc.NICK:
+		from, to := Nick(parsed), parsed.Trailing()
+		self.mtx.Lock()
+		mine := self.nick != "" && equalFold(from, self.nick)
+		if mine {
+			self.nick = to
+		}
+		wanted := wantedNickLocked()
+		self.mtx.Unlock()
+		if mine {
+			ircLog.Info("nick changed", "from", from, "to", to)
+		} else if equalFold(from, wanted) {
+			ircLog.Info("nick released, taking it", "nick", wanted, "by", to)
+			Post("NICK " + wanted)
+		}
+
+	case irc.QUIT:
+		if wanted := wantedNick(); equalFold(Nick(parsed), wanted) && !isMe(wanted) {
+			ircLog.Info("nick owner quit, taking the nick", "nick", wanted)
+			Post("NICK " + wanted)
+		}
+
+	case irc.ERR_NICKNAMEINUSE, irc.ERR_NICKCOLLISION, ERR_UNAVAILRESOURCE:
+		inUse := parsed.Param(1)
+		self.mtx.Lock()
+		registered := self.nick != ""
+		wanted := wantedNickLocked()
+		self.mtx.Unlock()
+		if registered {
+			// keep the current nick, e.g. after the nick command
+			ircLog.Warn("nick is not available", "nick", inUse, "reason", parsed.Trailing())
+			if equalFold(inUse, wanted) {
+				scheduleReclaim()
+			}
+			return nil
+		}
+		next := fallbackNick(wanted, inUse)
+		ircLog.Warn("nick is not available, trying another", "nick", inUse, "next", next)
+		Post("NICK " + next)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFallbackNick(t *testing.T) {
+	for inUse, want := range map[string]string{
+		"frank":   "frank_",
+		"frank_":  "frank__",
+		"frank__": "frank___",
+	} {
+		if got := fallbackNick("frank", inUse); got != want {
+			t.Errorf("fallbackNick(frank, %q) = %q, want %q", inUse, got, want)
+		}
+	}
+	for _, inUse := range []string{"frank___", "frank123"} {
+		got := fallbackNick("frank", inUse)
+		if !strings.HasPrefix(got, "frank") || len(got) != len("frank123") || strings.Contains(got, "_") {
+			t.Errorf("fallbackNick(frank, %q) = %q, want frank and digits", inUse, got)
+		}
+	}
+}
+
+func TestNickCollision(t *testing.T) {
+	c := defaultConfig()
+	c.Nick = "frank"
+	c.NickservPassword = "secret"
+	withConfig(t, c)
+
+	withOutbound(t, 10)
+
+	defer func() {
+		// stops the pending GHOST and reclaim
+		resetNick()
+		self.mtx.Lock()
+		defer self.mtx.Unlock()
+		self.wanted = ""
+	}()
+	resetNick()
+
+	sent := func() []string {
+		var lines []string
+		for {
+			line, ok := outbound.peek()
+			if !ok {
+				return lines
+			}
+			outbound.pop()
+			lines = append(lines, line)
+		}
+	}
+	feed := func(line string) {
+		t.Helper()
+		if err := runnerNick(nil, parseMessage(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// while registering, fall back to another nick
+	feed(":irc.example.net 433 * frank :Nickname is already in use")
+	if got := sent(); len(got) != 1 || got[0] != "NICK frank_" {
+		t.Errorf("sent %q, want NICK frank_", got)
+	}
+	feed(":irc.example.net 001 frank_ :Welcome")
+	if got := currentNick(); got != "frank_" {
+		t.Errorf("currentNick() = %q, want frank_", got)
+	}
+	if !IsPrivateQuery(parseMessage(":alice!a@host PRIVMSG frank_ :help")) {
+		t.Errorf("message to frank_ is not a query")
+	}
+	// GHOST and NICK follow after ghostDelay, see TestRegainFallback
+	if got := sent(); len(got) != 1 || got[0] != "PRIVMSG NickServ :REGAIN frank secret" {
+		t.Errorf("sent %q, want REGAIN", got)
+	}
+
+	// once registered, keep the fallback nick
+	feed(":irc.example.net 433 frank_ frank :Nickname is already in use")
+	if got := sent(); len(got) != 0 {
+		t.Errorf("sent %q, want nothing", got)
+	}
+
+	// take the nick as soon as it is free
+	feed(":frank!f@example.net QUIT :bye")
+	if got := sent(); len(got) != 1 || got[0] != "NICK frank" {
+		t.Errorf("sent %q, want NICK frank", got)
+	}
+	feed(":frank_!bot@example.net NICK :frank")
+	if got := currentNick(); got != "frank" {
+		t.Errorf("currentNick() = %q, want frank", got)
+	}
+
+	// the nick command changes the wanted nick
+	setWantedNick("frankie")
+	sent()
+	feed(":frank!bot@example.net NICK :frankie")
+	if got := currentNick(); got != "frankie" || !isMe("Frankie") {
+		t.Errorf("currentNick() = %q, want frankie", got)
+	}
+}
+
+func TestRegainFallback(t *testing.T) {
+	c := defaultConfig()
+	c.Nick = "frank"
+	c.NickservPassword = "secret"
+	withConfig(t, c)
+
+	withOutbound(t, 10)
+
+	self.mtx.Lock()
+	self.nick = "frank_"
+	self.mtx.Unlock()
+	defer resetNick()
+
+	// services without REGAIN leave us with frank_
+	regainNick(10 * time.Millisecond)
+	var got []string
+	for start := time.Now(); len(got) < 3 && time.Since(start) < 5*time.Second; {
+		line, ok := outbound.peek()
+		if !ok {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		outbound.pop()
+		got = append(got, line)
+	}
+	want := []string{"PRIVMSG NickServ :REGAIN frank secret", "PRIVMSG NickServ :GHOST frank secret", "NICK frank"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	// a new connection stops the pending GHOST
+	regainNick(10 * time.Millisecond)
+	outbound.pop() // REGAIN
+	resetNick()
+	time.Sleep(50 * time.Millisecond)
+	if line, ok := outbound.peek(); ok {
+		t.Errorf("sent %q after resetNick, want nothing", line)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"text/template"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// ChannelConfig overrides module behaviour for a single channel.
+type ChannelConfig struct {
+	// Modules enables (true) or disables (false) modules in this channel,
+	// e.g. {"urifind": false}. Modules not listed use their default.
+	Modules map[string]bool `json:"modules"`
+	// Settings holds module specific settings, e.g.
+	// {"greeter": {"template": "Hi {{ .Nick }}!"}}.
+	Settings map[string]map[string]string `json:"settings"`
+
+	// the parsed “template” setting of the greeter
+	greeting *template.Template
+}
+
+// moduleDefaults decide whether a module is enabled in channels without an
+// explicit setting. Modules without an entry are enabled everywhere.
+var moduleDefaults = map[string]func(c *Config, channel string) bool{
+	"greeter": func(c *Config, channel string) bool {
+		return containsFold(c.Greeter.Channels, channel)
+	},
+	"topicchanger": func(c *Config, channel string) bool {
+		return containsFold(c.TopicChanger.Channels, channel)
+	},
+}
+
+// moduleEnabled reports whether module may act in channel.
+func moduleEnabled(module, channel string) bool {
+	c := currentConfig()
+	if enabled, ok := channelSettings(c, channel).Modules[module]; ok {
+		return enabled
+	}
+	if def, ok := moduleDefaults[module]; ok {
+		return def(c, channel)
+	}
+	return true
+}
+
+// moduleSetting returns the setting key of module for channel, or "" if it
+// is not set.
+func moduleSetting(module, channel, key string) string {
+	return channelSettings(currentConfig(), channel).Settings[module][key]
+}
+
+// channelSettings returns the settings of channel, which may be spelled
+// differently in the config.
+func channelSettings(c *Config, channel string) ChannelConfig {
+	if cc, ok := c.ChannelSettings[channel]; ok {
+		return cc
+	}
+	for name, cc := range c.ChannelSettings {
+		if equalFold(name, channel) {
+			return cc
+		}
+	}
+	return ChannelConfig{}
+}
+
+// enabledChannels returns the channels frank is configured to join in which
+// module is enabled.
+func enabledChannels(module string) []string {
+	var result []string
+	for _, channel := range currentConfig().Channels {
+		if moduleEnabled(module, channel) {
+			result = append(result, channel)
+		}
+	}
+	return result
+}
+
+// messageChannel returns the channel a message refers to, or "" if it does
+// not refer to a single channel (e.g. QUIT, NICK or private messages).
+func messageChannel(parsed *Message) string {
+	var channel string
+	switch parsed.Command {
+	case irc.PRIVMSG, irc.NOTICE, irc.PART, irc.TOPIC, irc.KICK, irc.MODE, irc.JOIN:
+		channel = Target(parsed)
+	case irc.RPL_TOPIC, irc.RPL_NOTOPIC, irc.RPL_CHANNELMODEIS:
+		channel = parsed.Param(1)
+	case irc.RPL_NAMREPLY:
+		channel = parsed.Param(2)
+	}
+	if !isChannel(channel) {
+		return ""
+	}
+	return channel
+}
+
+// validateChannelSettings checks that only registered modules are
+// configured and parses the greeting templates.
+func (c *Config) validateChannelSettings() error {
+	known := make(map[string]bool)
+	for _, m := range allModules() {
+		known[m.Name] = true
+	}
+	normalized := make(map[string]ChannelConfig)
+	for channel, cc := range c.ChannelSettings {
+		ch, err := normalizeChannel(channel)
+		if err != nil {
+			return fmt.Errorf("channel_settings: %v", err)
+		}
+		if len(known) > 0 {
+			for module := range cc.Modules {
+				if !known[module] {
+					return fmt.Errorf("channel_settings[%s].modules: unknown module %q", channel, module)
+				}
+			}
+			for module := range cc.Settings {
+				if !known[module] {
+					return fmt.Errorf("channel_settings[%s].settings: unknown module %q", channel, module)
+				}
+			}
+		}
+		if text := cc.Settings["greeter"]["template"]; text != "" {
+			if cc.greeting, err = template.New(ch).Parse(text); err != nil {
+				return fmt.Errorf("channel_settings[%s].settings.greeter.template: %v", channel, err)
+			}
+		}
+		normalized[ch] = cc
+	}
+	c.ChannelSettings = normalized
+	return nil
+}
+
+// settingsSource returns the channel settings as configured, without what
+// validateChannelSettings parsed from them.
+func settingsSource(settings map[string]ChannelConfig) map[string]ChannelConfig {
+	result := make(map[string]ChannelConfig, len(settings))
+	for channel, cc := range settings {
+		cc.greeting = nil
+		result[channel] = cc
+	}
+	return result
+}
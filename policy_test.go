@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestModuleEnabled(t *testing.T) {
+	old := currentConfig()
+	defer setConfig(old)
+	registerModules()
+
+	path := writeTestConfig(t, `{
+		"channels": ["#chaos-hd", "#noname-ev", "#ops"],
+		"greeter": {"channels": ["#chaos-hd"]},
+		"channel_settings": {
+			"ops": {"modules": {"urifind": false}},
+			"#noname-ev": {
+				"modules": {"greeter": true},
+				"settings": {"greeter": {"template": "Hallo {{ .Nick }}!"}}
+			}
+		}
+	}`)
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, c)
+
+	tcs := []struct {
+		Module  string
+		Channel string
+		Want    bool
+	}{
+		{"urifind", "#chaos-hd", true},
+		{"urifind", "#ops", false},
+		{"greeter", "#chaos-hd", true},
+		{"greeter", "#noname-ev", true},
+		{"greeter", "#ops", false},
+		{"karma", "#ops", true},
+	}
+	for _, tc := range tcs {
+		if got := moduleEnabled(tc.Module, tc.Channel); got != tc.Want {
+			t.Errorf("moduleEnabled(%q, %q) = %v, want %v", tc.Module, tc.Channel, got, tc.Want)
+		}
+	}
+
+	if got, want := moduleSetting("greeter", "#noname-ev", "template"), "Hallo {{ .Nick }}!"; got != want {
+		t.Errorf("moduleSetting(greeter, #noname-ev, template) = %q, want %q", got, want)
+	}
+	if got := moduleSetting("greeter", "#chaos-hd", "template"); got != "" {
+		t.Errorf("moduleSetting(greeter, #chaos-hd, template) = %q, want it unset", got)
+	}
+	if channelSettings(c, "#noname-ev").greeting == nil {
+		t.Errorf("greeting template of #noname-ev was not parsed")
+	}
+
+	// templates parsed again on reload are no change
+	reloaded, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := configChanges(c, reloaded), []string{"nothing changed"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("configChanges(c, reloaded) = %q, want %q", got, want)
+	}
+}
+
+func TestMessageChannel(t *testing.T) {
+	tcs := map[string]string{
+		":alice!a@host PRIVMSG #chaos-hd :hi":                  "#chaos-hd",
+		":alice!a@host PRIVMSG frank :hi":                      "",
+		":alice!a@host JOIN :#chaos-hd":                        "#chaos-hd",
+		":alice!a@host QUIT :bye":                              "",
+		":irc.example.com 332 frank #chaos-hd :topic":          "#chaos-hd",
+		":irc.example.com 353 frank = #chaos-hd :alice @frank": "#chaos-hd",
+	}
+	for raw, want := range tcs {
+		if got := messageChannel(parseMessage(raw)); got != want {
+			t.Errorf("messageChannel(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how many messages may be queued for a single target before new ones are
+// dropped
+const maxQueuedPerTarget = 100
+
+type priority int
+
+const (
+	// protocol replies and registration, always sent before chatter
+	priorityHigh priority = iota
+	priorityNormal
+)
+
+// commands which are sent with priorityHigh
+var highPriorityCommands = map[string]bool{
+	"AUTHENTICATE": true,
+	"CAP":          true,
+	"JOIN":         true,
+	"MODE":         true,
+	"NICK":         true,
+	"PART":         true,
+	"PASS":         true,
+	"PING":         true,
+	"PONG":         true,
+	"QUIT":         true,
+	"TOPIC":        true,
+	"USER":         true,
+	"WHOIS":        true,
+}
+
+// classify returns the priority of an IRC line and the target it is
+// addressed to (for fair queuing between targets).
+func classify(line string) (priority, string) {
+	fields := strings.SplitN(line, " ", 3)
+	cmd := strings.ToUpper(fields[0])
+	if highPriorityCommands[cmd] {
+		return priorityHigh, ""
+	}
+	if len(fields) > 1 && (cmd == "PRIVMSG" || cmd == "NOTICE") {
+		return priorityNormal, fields[1]
+	}
+	return priorityNormal, ""
+}
+
+// outQueue holds outgoing lines until the token bucket allows sending them.
+// Lines with priorityHigh are sent first, the others round-robin across their
+// targets, so that a long reply to one user does not delay everybody else.
+type outQueue struct {
+	mtx     sync.Mutex
+	high    []string
+	targets map[string][]string
+	// targets with pending lines, in the order they will be served
+	order []string
+	// signalled (non-blocking) whenever a line is pushed
+	pushed chan struct{}
+
+	// token bucket
+	burst    int
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+
+	sent    int
+	dropped int
+}
+
+func newOutQueue(burst int, interval time.Duration) *outQueue {
+	return &outQueue{
+		targets:  make(map[string][]string),
+		pushed:   make(chan struct{}, 1),
+		burst:    burst,
+		interval: interval,
+		tokens:   float64(burst),
+		last:     time.Now(),
+	}
+}
+
+func (q *outQueue) push(line string) {
+	prio, target := classify(line)
+	q.pushPriority(line, prio, target)
+}
+
+// pushPriority queues line with the given priority instead of the one
+// derived from its command.
+func (q *outQueue) pushPriority(line string, prio priority, target string) {
+	q.mtx.Lock()
+	if prio == priorityHigh {
+		q.high = append(q.high, line)
+	} else if len(q.targets[target]) >= maxQueuedPerTarget {
+		q.dropped++
+		q.mtx.Unlock()
+		ircLog.Warn("outbound queue is full, dropping line", "target", target, "line", redactLine(line))
+		return
+	} else {
+		if len(q.targets[target]) == 0 {
+			q.order = append(q.order, target)
+		}
+		q.targets[target] = append(q.targets[target], line)
+	}
+	q.mtx.Unlock()
+
+	select {
+	case q.pushed <- struct{}{}:
+	default:
+	}
+}
+
+// peek returns the line which is to be sent next, without removing it.
+func (q *outQueue) peek() (string, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.high) > 0 {
+		return q.high[0], true
+	}
+	if len(q.order) > 0 {
+		return q.targets[q.order[0]][0], true
+	}
+	return "", false
+}
+
+// pop removes the line previously returned by peek.
+func (q *outQueue) pop() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.sent++
+	if len(q.high) > 0 {
+		q.high = q.high[1:]
+		return
+	}
+	target := q.order[0]
+	q.order = q.order[1:]
+	q.targets[target] = q.targets[target][1:]
+	if len(q.targets[target]) > 0 {
+		// back of the line
+		q.order = append(q.order, target)
+	} else {
+		delete(q.targets, target)
+	}
+}
+
+// take blocks until the token bucket allows sending another line.
+func (q *outQueue) take() {
+	for {
+		q.mtx.Lock()
+		now := time.Now()
+		q.tokens += float64(now.Sub(q.last)) / float64(q.interval)
+		if q.tokens > float64(q.burst) {
+			q.tokens = float64(q.burst)
+		}
+		q.last = now
+		if q.tokens >= 1 {
+			q.tokens--
+			q.mtx.Unlock()
+			return
+		}
+		wait := time.Duration((1 - q.tokens) * float64(q.interval))
+		q.mtx.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// reset drops all queued lines, e.g. JOINs and PONGs meant for a connection
+// which is gone, and returns how many were dropped.
+func (q *outQueue) reset() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	n := len(q.high)
+	for _, lines := range q.targets {
+		n += len(lines)
+	}
+	q.high = nil
+	q.targets = make(map[string][]string)
+	q.order = nil
+	q.dropped += n
+	return n
+}
+
+// Len returns the number of queued lines.
+func (q *outQueue) Len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	n := len(q.high)
+	for _, lines := range q.targets {
+		n += len(lines)
+	}
+	return n
+}
+
+func (q *outQueue) stats() map[string]interface{} {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	targets := make(map[string]int)
+	for target, lines := range q.targets {
+		targets[target] = len(lines)
+	}
+	return map[string]interface{}{
+		"high":    len(q.high),
+		"targets": targets,
+		"sent":    q.sent,
+		"dropped": q.dropped,
+	}
+}
+
+// run sends queued lines on the current connection. Never returns.
+func (q *outQueue) run() {
+	for {
+		line, ok := q.peek()
+		if !ok {
+			<-q.pushed
+			continue
+		}
+
+		t := currentTransport()
+		if t == nil {
+			// keep the line until we are connected again
+			time.Sleep(time.Second)
+			continue
+		}
+
+		q.take()
+		// a high priority line might have been queued in the meantime
+		if line, ok = q.peek(); !ok {
+			continue
+		}
+		q.pop()
+
+		if ircLog.Enabled(LevelDebug) {
+			ircLog.Debug("sent", "line", redactLine(line))
+		}
+		if err := t.Send(line); err == errInvalidLine {
+			// a bug in whoever queued it, not a connection problem
+			ircLog.Error("dropping invalid line", "line", redactLine(line), "err", err)
+			continue
+		} else if err != nil {
+			ircLog.Warn("could not post message", "err", err)
+			connectionFailed(t, err)
+			continue
+		}
+		messagesSent.WithLabelValues(lineCommand(line)).Inc()
+	}
+}
+
+// drain waits until the queue is empty, but at most for timeout.
+func (q *outQueue) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for q.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+var outbound = newOutQueue(5, 2*time.Second)
+
+func setupOutbound() {
+	c := currentConfig()
+	outbound = newOutQueue(c.Flood.Burst, c.Flood.Interval.Duration)
+	go outbound.run()
+
+	expvar.Publish("outbound_queue", expvar.Func(func() interface{} {
+		return outbound.stats()
+	}))
+}
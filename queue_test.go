@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withOutbound replaces the outbound queue with an empty one with the given
+// burst until the test ends. Unless the test runs it, nothing sends the
+// lines: tests take them using peek and pop.
+func withOutbound(t *testing.T, burst int) {
+	t.Helper()
+	old := outbound
+	t.Cleanup(func() { outbound = old })
+	outbound = newOutQueue(burst, time.Millisecond)
+}
+
+func TestOutQueueOrder(t *testing.T) {
+	q := newOutQueue(1, time.Second)
+	for _, line := range []string{
+		"PRIVMSG alice :help 1",
+		"PRIVMSG alice :help 2",
+		"PRIVMSG alice :help 3",
+		"PRIVMSG #chaos-hd :[Link Info] title",
+		"PONG :irc.example.com",
+		"PRIVMSG bob :hi",
+		"TOPIC #chaos-hd",
+	} {
+		q.push(line)
+	}
+
+	var got []string
+	for {
+		line, ok := q.peek()
+		if !ok {
+			break
+		}
+		q.pop()
+		got = append(got, line)
+	}
+
+	want := []string{
+		"PONG :irc.example.com",
+		"TOPIC #chaos-hd",
+		"PRIVMSG alice :help 1",
+		"PRIVMSG #chaos-hd :[Link Info] title",
+		"PRIVMSG bob :hi",
+		"PRIVMSG alice :help 2",
+		"PRIVMSG alice :help 3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected order:\n GOT: %q\nWANT: %q", got, want)
+	}
+}
+
+func TestOutQueueReset(t *testing.T) {
+	q := newOutQueue(1, time.Second)
+	q.push("JOIN #old")
+	q.push("PRIVMSG #old :hi")
+	if n := q.reset(); n != 2 {
+		t.Errorf("reset() = %d, want 2", n)
+	}
+	q.push("NICK frank")
+	if line, ok := q.peek(); !ok || line != "NICK frank" {
+		t.Errorf("peek() = %q after reset, want NICK frank", line)
+	}
+}
+
+func TestJoinAfterInvite(t *testing.T) {
+	c := defaultConfig()
+	c.NickservPassword = "secret"
+	withConfig(t, c)
+	withOutbound(t, 10)
+
+	Privmsg("#chaos-hd", "chatter")
+	Join("#noname-ev")
+	var got []string
+	for {
+		line, ok := outbound.peek()
+		if !ok {
+			break
+		}
+		outbound.pop()
+		got = append(got, line)
+	}
+	want := []string{"PRIVMSG chanserv :invite #noname-ev", "JOIN #noname-ev", "PRIVMSG #chaos-hd :chatter"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestOutQueueLimit(t *testing.T) {
+	q := newOutQueue(1, time.Second)
+	for i := 0; i < maxQueuedPerTarget+10; i++ {
+		q.push("PRIVMSG #spam :x")
+	}
+	q.push("PRIVMSG #other :y")
+	if got, want := q.Len(), maxQueuedPerTarget+1; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+}
+
+func TestOutQueueTokenBucket(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	q := newOutQueue(3, interval)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		q.take()
+	}
+	// the first 3 tokens are available immediately, the other two need
+	// to be refilled
+	if elapsed := time.Since(start); elapsed < 2*interval {
+		t.Errorf("took 5 tokens in %v, expected at least %v", elapsed, 2*interval)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits how often users may use a feature, separately for every
+// nick and channel. Each of them may use it burst times in a row, after which
+// one more use is allowed every interval (a token bucket).
+type rateLimiter struct {
+	// name is used in the slow-down notice, e.g. “karma voting”.
+	name     string
+	burst    int
+	interval time.Duration
+
+	mtx     sync.Mutex
+	buckets map[string]*bucket
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// warned is set once the user has been told to slow down, until they
+	// may use the feature again.
+	warned bool
+}
+
+// forget buckets which have been full for a while once there are that many
+const maxBuckets = 1000
+
+var rateLimiters = struct {
+	mtx sync.Mutex
+	all []*rateLimiter
+}{}
+
+func newRateLimiter(name string, burst int, interval time.Duration) *rateLimiter {
+	l := &rateLimiter{
+		name:     name,
+		burst:    burst,
+		interval: interval,
+		buckets:  make(map[string]*bucket),
+		now:      time.Now,
+	}
+	rateLimiters.mtx.Lock()
+	defer rateLimiters.mtx.Unlock()
+	rateLimiters.all = append(rateLimiters.all, l)
+	return l
+}
+
+func rateLimitKey(nick, channel string) string {
+	return fold(nick) + " " + fold(channel)
+}
+
+// refill adds the tokens earned since b was last used. l.mtx must be held.
+func (l *rateLimiter) refill(b *bucket, now time.Time) {
+	b.tokens += float64(now.Sub(b.last)) / float64(l.interval)
+	if max := float64(l.burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// allow reports whether nick, who has role, may use the feature in channel
+// now, and uses it up if so. Otherwise, warn is true the first time in a row,
+// and wait is how long until the next use is allowed. Admins are exempt; all
+// limits are enforced here.
+func (l *rateLimiter) allow(nick, channel string, role Role) (ok, warn bool, wait time.Duration) {
+	if role >= RoleTrusted {
+		return true, false, 0
+	}
+	now := l.now()
+	key := rateLimitKey(nick, channel)
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	b, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		b.warned = false
+		return true, false, 0
+	}
+	warn = !b.warned
+	b.warned = true
+	wait = time.Duration((1 - b.tokens) * float64(l.interval))
+	return false, warn, wait
+}
+
+// limited reports whether allow would refuse nick in channel now, without
+// using anything up.
+func (l *rateLimiter) limited(nick, channel string) bool {
+	now := l.now()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	b, found := l.buckets[rateLimitKey(nick, channel)]
+	if !found {
+		return false
+	}
+	l.refill(b, now)
+	return b.tokens < 1
+}
+
+// prune forgets all full buckets. l.mtx must be held.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Allow is like allow for the sender of msg, but tells users to slow down
+// (once) instead of returning details. It is meant for listeners. The role
+// only matters once the limit is reached: if it depends on an account which
+// is not known yet, the account is looked up for the next time.
+func (l *rateLimiter) Allow(msg *Message, channel string) bool {
+	nick := Nick(msg)
+	role := RoleNone
+	if l.limited(nick, channel) {
+		role, _ = userRole(msg, func(Role) {})
+	}
+	ok, warn, wait := l.allow(nick, channel, role)
+	if !ok {
+		commandsLog.Info("rate limited", "nick", nick, "feature", l.name, "channel", channel)
+		if warn {
+			Privmsg(nick, slowDownNotice(l.name, wait))
+		}
+	}
+	return ok
+}
+
+// reset lifts the limit for nick in all channels and returns how many buckets
+// were reset.
+func (l *rateLimiter) reset(nick string) int {
+	prefix := fold(nick) + " "
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	n := 0
+	for key := range l.buckets {
+		if strings.HasPrefix(key, prefix) {
+			delete(l.buckets, key)
+			n++
+		}
+	}
+	return n
+}
+
+func slowDownNotice(name string, wait time.Duration) string {
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return fmt.Sprintf("Please slow down, you can use %s again in %v.", name, wait.Round(time.Second))
+}
+
+// unthrottle lifts all rate limits for nick.
+func unthrottle(nick string) int {
+	rateLimiters.mtx.Lock()
+	defer rateLimiters.mtx.Unlock()
+	n := 0
+	for _, l := range rateLimiters.all {
+		n += l.reset(nick)
+	}
+	return n
+}
+
+var unthrottleCommand = &Command{
+	Module:  "admin",
+	Name:    "unthrottle",
+	Usage:   "<nick>",
+	Help:    "lifts all rate limits of a user, e.g. for karma voting or help",
+	MinArgs: 1,
+	MaxArgs: 1,
+	Query:   true,
+	Role:    RoleOperator,
+	Run: func(inv *Invocation) error {
+		nick := inv.Args[0]
+		if n := unthrottle(nick); n == 0 {
+			inv.Reply(nick + " is not rate limited")
+		} else {
+			inv.Reply(fmt.Sprintf("lifted %d rate limits of %s", n, nick))
+		}
+		return nil
+	},
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter("testing", 2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	type use struct {
+		nick, channel string
+		ok, warn      bool
+	}
+	check := func(uses ...use) {
+		t.Helper()
+		for _, u := range uses {
+			ok, warn, _ := l.allow(u.nick, u.channel, RoleNone)
+			if ok != u.ok || warn != u.warn {
+				t.Errorf("allow(%q, %q) = %v, %v, want %v, %v", u.nick, u.channel, ok, warn, u.ok, u.warn)
+			}
+		}
+	}
+
+	check(
+		use{"alice", "#a", true, false},
+		use{"Alice", "#a", true, false},
+		// only the first denied use warns
+		use{"alice", "#a", false, true},
+		use{"alice", "#a", false, false},
+		// other channels and users are not affected
+		use{"alice", "#b", true, false},
+		use{"bob", "#a", true, false},
+	)
+
+	now = now.Add(30 * time.Second)
+	if ok, _, wait := l.allow("alice", "#a", RoleNone); ok || wait != 30*time.Second {
+		t.Errorf("allow after 30s = %v, wait %v, want 30s", ok, wait)
+	}
+	now = now.Add(30 * time.Second)
+	check(
+		use{"alice", "#a", true, false},
+		// warned again after having been allowed
+		use{"alice", "#a", false, true},
+	)
+
+	// the bucket refills up to burst
+	now = now.Add(time.Hour)
+	check(
+		use{"alice", "#a", true, false},
+		use{"alice", "#a", true, false},
+		use{"alice", "#a", false, true},
+	)
+
+	if n := l.reset("ALICE"); n != 2 {
+		t.Errorf("reset(alice) reset %d buckets, want 2", n)
+	}
+	check(use{"alice", "#a", true, false})
+}
+
+func TestRateLimitedCommand(t *testing.T) {
+	withOutbound(t, 10)
+
+	ran := 0
+	cmd := &Command{
+		Name:      "limited",
+		Channel:   true,
+		RateLimit: newRateLimiter("limited", 1, time.Hour),
+		Run: func(*Invocation) error {
+			ran++
+			return nil
+		},
+	}
+	inv := &Invocation{Cmd: cmd, Nick: "alice", Channel: "#test"}
+	for i := 0; i < 3; i++ {
+		if err := runInvocation(inv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ran != 1 {
+		t.Errorf("command ran %d times, want 1", ran)
+	}
+	if line, _ := outbound.peek(); !strings.HasPrefix(line, "PRIVMSG alice :Please slow down") {
+		t.Errorf("sent %q, want a slow-down notice", line)
+	}
+	outbound.pop()
+	if line, ok := outbound.peek(); ok {
+		t.Errorf("sent %q, want only one notice", line)
+	}
+
+	// admins are exempt
+	inv.Role = RoleTrusted
+	if err := runInvocation(inv); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 2 {
+		t.Errorf("command ran %d times for an admin, want 2", ran)
+	}
+}
+
+func TestRateLimitAdminRole(t *testing.T) {
+	c := defaultConfig()
+	c.Admins = []AdminConfig{{Hostmask: "*!*@nnev/staff/*", Role: RoleTrusted}}
+	withConfig(t, c)
+
+	withOutbound(t, 10)
+
+	runs := make(map[string]int)
+	withCommands(t)
+	CommandAdd(&Command{
+		Name:      "limitedrole",
+		Channel:   true,
+		RateLimit: newRateLimiter("limitedrole", 1, time.Hour),
+		Run: func(inv *Invocation) error {
+			runs[inv.Nick]++
+			return nil
+		},
+	})
+	for i := 0; i < 3; i++ {
+		for _, raw := range []string{
+			":staffer!s@nnev/staff/staffer PRIVMSG #test :!limitedrole",
+			":eve!e@example.net PRIVMSG #test :!limitedrole",
+		} {
+			if err := runnerCommands(context.Background(), parseMessage(raw)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if want := map[string]int{"staffer": 3, "eve": 1}; !reflect.DeepEqual(runs, want) {
+		t.Errorf("command ran %v times, want %v", runs, want)
+	}
+}
+
+func TestRateLimitListenerAdmin(t *testing.T) {
+	c := defaultConfig()
+	c.Admins = []AdminConfig{{Hostmask: "*!*@nnev/staff/*", Role: RoleTrusted}}
+	withConfig(t, c)
+	withOutbound(t, 10)
+
+	l := newRateLimiter("testing listeners", 1, time.Hour)
+	allowed := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		for _, raw := range []string{
+			":staffer!s@nnev/staff/staffer PRIVMSG #test :frank++",
+			":eve!e@example.net PRIVMSG #test :frank++",
+		} {
+			msg := parseMessage(raw)
+			if l.Allow(msg, "#test") {
+				allowed[Nick(msg)]++
+			}
+		}
+	}
+	if want := map[string]int{"staffer": 3, "eve": 1}; !reflect.DeepEqual(allowed, want) {
+		t.Errorf("allowed %v times, want %v", allowed, want)
+	}
+}
@@ -1,47 +1,47 @@
 package main
 
 import (
-	"log"
 	"os/exec"
-	"regexp"
+	"sync"
 	"time"
-
-	"gopkg.in/sorcix/irc.v2"
 )
 
-const hostToPing = "chaostreff.vpn.zekjur.net"
-
-var bangRaumRegex = regexp.MustCompile(`(?i)^!raum($|\s)`)
-var bangRaumLast = time.Now().Add(time.Second * -5)
-
-func runnerRaumbang(parsed *irc.Message) error {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("MEGA-WTF:pkg: %v", r)
-		}
-	}()
+var raumbangLog = newLogger("raumbang")
 
-	if !IsPrivateQuery(parsed) {
-		return nil
-	}
+var bangRaumLast = struct {
+	mtx sync.Mutex
+	t   time.Time
+}{t: time.Now().Add(time.Second * -5)}
 
-	if !bangRaumRegex.MatchString(parsed.Trailing()) {
-		return nil
-	}
+var raumbangModule = &Module{
+	Name:        "raumbang",
+	Description: "tells you whether the room is likely open",
+}
 
-	dur := time.Since(bangRaumLast)
+var raumCommand = &Command{
+	Module: "raumbang",
+	Name:   "raum",
+	Help:   "tells you whether the room is likely open",
+	Query:  true,
+	Run:    runRaumbang,
+}
 
+func runRaumbang(inv *Invocation) error {
+	bangRaumLast.mtx.Lock()
+	dur := time.Since(bangRaumLast.t)
 	if dur.Seconds() <= 5 {
-		log.Printf("WTF: last room stat request was %v seconds ago, skipping", dur)
+		bangRaumLast.mtx.Unlock()
+		raumbangLog.Info("skipping room stat request, the last one was too recent", "ago", dur)
 		return nil
 	}
+	bangRaumLast.t = time.Now()
+	bangRaumLast.mtx.Unlock()
 
-	log.Printf("Received room stat request from %s", Nick(parsed))
-	bangRaumLast = time.Now()
+	raumbangLog.Info("received room stat request", "nick", inv.Nick)
 
-	n := Nick(parsed)
+	n := inv.Nick
 
-	err := exec.Command("ping", "-q", "-l 3", "-c 3", "-w 1", hostToPing).Run()
+	err := exec.CommandContext(inv.Ctx, "ping", "-q", "-l 3", "-c 3", "-w 1", currentConfig().Raumbang.HostToPing).Run()
 	if err != nil {
 		Privmsg(n, "No reply, so room is probably not yet open.")
 	} else {
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+var rssLog = newLogger("rss")
+
 // how often to check the feeds (in minutes)
 const checkEvery = 3
 
@@ -23,19 +27,33 @@ const retryAfter = 9
 // how many items to show if there have been many updates in an interval
 const maxItems = 3
 
-var bootTimestamp = time.Now()
+var rssModule = &Module{
+	Name:        "rss",
+	Description: "announces new entries of some feeds",
+}
 
 var rssHttpClient = http.Client{Timeout: 10 * time.Second}
 
+// closed to stop the currently running pollers
+var rssStop = struct {
+	mtx sync.Mutex
+	c   chan struct{}
+}{}
+
+// Rss starts a poller for every configured feed. Pollers started by earlier
+// calls are stopped, so this can be called again after the config changed.
 func Rss() {
-	// this feels wrong, the missing alignment making it hard to read.
-	// Does anybody have a suggestion how to make this nice in go?
-	// go pollFeed("#i3", "i3faq", timeFormat1, "https://faq.i3wm.org/feeds/rss/")
+	rssStop.mtx.Lock()
+	defer rssStop.mtx.Unlock()
+
+	if rssStop.c != nil {
+		close(rssStop.c)
+	}
+	rssStop.c = make(chan struct{})
 
-	go pollFeed("#chaos-hd", "nn-web", "https://www.noname-ev.de/gitcommits.atom")
-	go pollFeed("#chaos-hd", "nn-wiki", "https://www.noname-ev.de/wiki/index.php?title=Special:RecentChanges&feed=atom")
-	go pollFeed("#chaos-hd", "nn-planet", "http://blogs.noname-ev.de/atom.xml")
-	go pollFeed("#chaos-hd", "frank", "https://github.com/nnev/frank/commits/robust.atom")
+	for _, f := range currentConfig().RSS.Feeds {
+		go pollFeed(rssStop.c, f.Channel, f.Name, f.URL)
+	}
 }
 
 type Feed struct {
@@ -53,19 +71,15 @@ func (f Feed) postableForIrc() []string {
 
 	for _, entry := range f.Entry {
 		if !entry.RecentlyPublished() {
-			if *verbose {
-				log.Printf("RSS: skipping non-recent entry. published @ %s :: %s %s", entry.Updated, f.Title(), entry.Title())
-			}
+			rssLog.Debug("skipping non-recent entry", "published", entry.Updated, "feed", f.Title(), "title", entry.Title())
 			continue
 		}
 
-		if isRecentUrl(entry.Href()) {
-			if *verbose {
-				log.Printf("RSS: skipping already already posted :: %s %s", f.Title(), entry.Title())
-			}
+		if recent.contains(entry.Href()) {
+			rssLog.Debug("skipping already posted entry", "feed", f.Title(), "title", entry.Title())
 			continue
 		}
-		addRecentUrl(entry.Href())
+		recent.add(entry.Href())
 
 		oneLiners = appendIfMiss(oneLiners, entry.OneLiner())
 	}
@@ -122,13 +136,13 @@ type Link struct {
 func loadURL(url string) []byte {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		log.Printf("RSS: could not construct HTTP request: %v", err)
+		rssLog.Warn("could not construct HTTP request", "err", err)
 		return nil
 	}
 	req.Header.Set("User-Agent", "https://github.com/nnev/frank")
 	r, err := rssHttpClient.Do(req)
 	if err != nil {
-		log.Printf("RSS: could resolve URL %s: %s", url, err)
+		rssLog.Warn("could not resolve URL", "url", url, "err", err)
 		return nil
 	}
 	defer r.Body.Close()
@@ -137,28 +151,33 @@ func loadURL(url string) []byte {
 	limitedBody := io.LimitReader(r.Body, 1024*1024)
 	body, err := ioutil.ReadAll(limitedBody)
 	if err != nil {
-		log.Printf("RSS: could read data from URL %s: %s", url, err)
+		rssLog.Warn("could not read data", "url", url, "err", err)
 		return nil
 	}
 
 	return body
 }
 
-func parseAtomFeed(url string) Feed {
+// parseAtomFeed fetches and parses the feed at url. Errors are logged, too.
+func parseAtomFeed(url string) (Feed, error) {
 	f := Feed{}
 	if err := xml.Unmarshal(loadURL(url), &f); err != nil {
-		log.Printf("RSS: could not parse %s: %s", url, err)
+		rssLog.Warn("could not parse feed", "url", url, "err", err)
+		return f, err
 	}
 
-	return f
+	return f, nil
 }
 
-func pollFeed(channel string, feedName string, url string) {
+func pollFeed(stop <-chan struct{}, channel string, feedName string, url string) {
 	for {
-		time.Sleep(checkEvery * time.Minute)
-		if *verbose {
-			log.Printf("RSS %s: checking", feedName)
+		select {
+		case <-stop:
+			rssLog.Info("stopping", "feed", feedName)
+			return
+		case <-time.After(checkEvery * time.Minute):
 		}
+		rssLog.Debug("checking", "feed", feedName)
 		pollFeedRunner(channel, feedName, url)
 	}
 }
@@ -166,15 +185,25 @@ func pollFeed(channel string, feedName string, url string) {
 func pollFeedRunner(channel string, feedName string, url string) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("MEGA-WTF:pkg:RSS: %v", r)
+			rssLog.Error("polling feed panicked", "feed", feedName, "panic", r)
 			time.Sleep(retryAfter * time.Minute)
 			return
 		}
 	}()
 
-	postitems := parseAtomFeed(url).postableForIrc()
+	if !moduleEnabled("rss", channel) {
+		return
+	}
+
+	f, err := parseAtomFeed(url)
+	if err != nil {
+		rssPolls.WithLabelValues(feedName, "error").Inc()
+		return
+	}
+	rssPolls.WithLabelValues(feedName, "ok").Inc()
+	postitems := f.postableForIrc()
 	cnt := len(postitems)
-	log.Printf("RSS %s: found %d new items: %v", feedName, cnt, postitems)
+	rssLog.Debug("found new items", "feed", feedName, "count", cnt, "items", postitems)
 
 	// hide updates if they exceed the maxItems counter. If there’s only
 	// one more item in the list than specified in maxItems, all of the
@@ -184,14 +213,15 @@ func pollFeedRunner(channel string, feedName string, url string) {
 		msg := fmt.Sprintf("::%s:: had %d updates, showing the latest %d", feedName, cnt, maxItems)
 		Privmsg(channel, msg)
 		postitems = postitems[cnt-maxItems : cnt]
-		log.Printf("RSS %s: posting %s", feedName, msg)
+		rssLog.Info("posting", "feed", feedName, "item", msg)
 	}
 
 	// newer items appear first in feeds, so reverse them here to keep
 	// the order in line with how IRC wprks
 	for i := len(postitems) - 1; i >= 0; i -= 1 {
 		Privmsg(channel, "::"+feedName+":: "+postitems[i])
-		log.Printf("RSS %s: posting %s", feedName, postitems[i])
+		rssItemsPosted.WithLabelValues(feedName).Inc()
+		rssLog.Info("posting", "feed", feedName, "item", postitems[i])
 	}
 }
 
@@ -205,23 +235,91 @@ func appendIfMiss(slice []string, s string) []string {
 	return append(slice, s)
 }
 
-// LIFO that stores the recent posted URLs. Used to avoid posting entries multiple times.
-var recent []string = make([]string, 50)
-var recentIndex = 0
+// recentURLs is a ring buffer that stores the recently posted URLs. Used to
+// avoid posting entries multiple times. All feeds share it, so it is safe for
+// concurrent use. If namespace is set, the URLs are kept in the store (with
+// the time they were posted) to survive restarts.
+type recentURLs struct {
+	mtx       sync.Mutex
+	urls      []string
+	index     int
+	namespace string
+}
+
+func newRecentURLs(size int, namespace string) *recentURLs {
+	return &recentURLs{urls: make([]string, size), namespace: namespace}
+}
+
+func (r *recentURLs) add(url string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	evicted := r.urls[r.index]
+	r.urls[r.index] = url
+	r.index = (r.index + 1) % len(r.urls)
+
+	if r.namespace == "" {
+		return
+	}
+	err := store.Update(func(tx Tx) error {
+		if evicted != "" {
+			if err := tx.Delete(r.namespace, evicted); err != nil {
+				return err
+			}
+		}
+		return putJSON(tx, r.namespace, url, time.Now())
+	})
+	if err != nil {
+		rssLog.Error("could not store seen URL", "err", err)
+	}
+}
+
+// load restores the most recently posted URLs from the store.
+func (r *recentURLs) load() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
 
-func addRecentUrl(url string) {
-	recent[recentIndex] = url
-	recentIndex += 1
-	if len(recent) == recentIndex {
-		recentIndex = 0
+	type seen struct {
+		url  string
+		date time.Time
+	}
+	var stored []seen
+	err := store.View(func(tx Tx) error {
+		return tx.ForEach(r.namespace, func(key string, value []byte) error {
+			var date time.Time
+			if err := json.Unmarshal(value, &date); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			stored = append(stored, seen{key, date})
+			return nil
+		})
+	})
+	if err != nil {
+		rssLog.Error("could not read seen URLs", "err", err)
+		return
 	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].date.Before(stored[j].date)
+	})
+	if len(stored) > len(r.urls) {
+		stored = stored[len(stored)-len(r.urls):]
+	}
+	for i, s := range stored {
+		r.urls[i] = s.url
+	}
+	r.index = len(stored) % len(r.urls)
 }
 
-func isRecentUrl(url string) bool {
-	for _, a := range recent {
+func (r *recentURLs) contains(url string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, a := range r.urls {
 		if url == a {
 			return true
 		}
 	}
 	return false
 }
+
+const rssSeenNamespace = "rss-seen"
+
+var recent = newRecentURLs(50, rssSeenNamespace)
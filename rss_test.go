@@ -11,15 +11,16 @@ import (
 )
 
 func TestRecent(t *testing.T) {
+	recent := newRecentURLs(50, "")
 	for i := 0; i < 100; i += 1 {
-		addRecentUrl(strconv.Itoa(i))
+		recent.add(strconv.Itoa(i))
 	}
 
-	if !isRecentUrl("99") {
+	if !recent.contains("99") {
 		t.Errorf("99 should be recent URL")
 	}
 
-	if isRecentUrl("1") {
+	if recent.contains("1") {
 		t.Errorf("1 shouldn’t be recent URL")
 	}
 }
@@ -65,13 +66,22 @@ func TestLoadURL(t *testing.T) {
 }
 
 func TestPostableForIrc(t *testing.T) {
+	// start without the URLs posted by earlier runs, and do not store them
+	old := recent
+	t.Cleanup(func() { recent = old })
+	recent = newRecentURLs(50, "")
+
 	// simple detect
 	feedUpdated := time.Now().Add(time.Minute)
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, atomPlanetSample(feedUpdated))
 	}))
 	defer ts.Close()
-	postitems := parseAtomFeed(ts.URL).postableForIrc()
+	f, err := parseAtomFeed(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postitems := f.postableForIrc()
 
 	if len(postitems) != 1 || postitems[0] != "TITLE http://blog.ezelo.de/ipod_shuffle_linux/" {
 		t.Errorf("should contain the post as postable for irc")
@@ -83,7 +93,11 @@ func TestPostableForIrc(t *testing.T) {
 		fmt.Fprintln(w, atomPlanetSample(feedUpdated))
 	}))
 	defer ts.Close()
-	postitems = parseAtomFeed(ts.URL).postableForIrc()
+	f, err = parseAtomFeed(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postitems = f.postableForIrc()
 
 	if len(postitems) != 0 {
 		t.Errorf("should not contain posts created before freshness period")
@@ -95,7 +109,11 @@ func TestPostableForIrc(t *testing.T) {
 		fmt.Fprintln(w, atomGithubSample(feedUpdated))
 	}))
 	defer ts.Close()
-	postitems = parseAtomFeed(ts.URL).postableForIrc()
+	f, err = parseAtomFeed(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postitems = f.postableForIrc()
 
 	if len(postitems) != 2 {
 		t.Errorf("should contain both items, but contains %s", postitems)
@@ -107,7 +125,11 @@ func TestPostableForIrc(t *testing.T) {
 		fmt.Fprintln(w, atomGithubSample(feedUpdated))
 	}))
 	defer ts.Close()
-	postitems = parseAtomFeed(ts.URL).postableForIrc()
+	f, err = parseAtomFeed(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postitems = f.postableForIrc()
 
 	if len(postitems) != 0 {
 		t.Errorf("should not contain any items created before booting %s", postitems)
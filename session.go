@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// ircLog logs the connection and the IRC protocol, every line sent and
+// received at debug level.
+var ircLog = newLogger("irc")
+
+const (
+	// how long to wait before the first reconnect attempt. Doubles with
+	// every failed attempt up to reconnectMaxBackoff.
+	reconnectMinBackoff = 5 * time.Second
+	reconnectMaxBackoff = 5 * time.Minute
+
+	// connections that lasted at least this long reset the backoff
+	reconnectStableAfter = 10 * time.Minute
+)
+
+var errMessagesClosed = errors.New("connection closed by remote side")
+
+// the active connection, nil while (re)connecting
+var conn = struct {
+	mtx sync.RWMutex
+	t   Transport
+	// receives errors encountered while sending on t
+	failed chan error
+	// when t was established
+	since time.Time
+	// number of times the connection was re-established
+	reconnects int
+}{}
+
+func currentTransport() Transport {
+	conn.mtx.RLock()
+	defer conn.mtx.RUnlock()
+	return conn.t
+}
+
+func setTransport(t Transport) {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	conn.t = t
+	conn.since = time.Now()
+	conn.failed = make(chan error, 1)
+}
+
+// connectionStatus describes the current connection for admins.
+func connectionStatus() (t Transport, since time.Time, reconnects int) {
+	conn.mtx.RLock()
+	defer conn.mtx.RUnlock()
+	return conn.t, conn.since, conn.reconnects
+}
+
+// connectionFailed makes the supervisor reconnect t, unless it already did.
+func connectionFailed(t Transport, err error) {
+	conn.mtx.RLock()
+	defer conn.mtx.RUnlock()
+	if conn.t != t {
+		return
+	}
+	select {
+	case conn.failed <- err:
+	default:
+	}
+}
+
+func connect() (Transport, error) {
+	c := currentConfig()
+	t, err := newTransport(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Connect(); err != nil {
+		return nil, err
+	}
+	ircLog.Info("connected", "nick", c.Nick, "transport", t.ID())
+	return t, nil
+}
+
+// superviseSession keeps frank connected: whenever the connection fails it is
+// closed and recreated with exponential backoff. All module state lives
+// outside the connection, so it survives reconnects. Never returns.
+func superviseSession() {
+	backoff := reconnectMinBackoff
+	for {
+		t, err := connect()
+		if err != nil {
+			ircLog.Warn("could not connect", "retry_in", backoff, "err", err)
+			time.Sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		started := time.Now()
+		// lines queued for the old connection would be sent before
+		// registering on the new one
+		if n := outbound.reset(); n > 0 {
+			ircLog.Info("dropped lines queued for the old connection", "lines", n)
+		}
+		setTransport(t)
+		boot()
+		err = serve(t)
+		setTransport(nil)
+
+		ircLog.Warn("connection lost", "after", time.Since(started).Round(time.Second), "err", err)
+		go func() {
+			// best effort, the connection is likely broken anyway
+			if err := t.Close(currentConfig().Nick + " reconnects"); err != nil {
+				ircLog.Warn("could not properly close the old connection", "err", err)
+			}
+		}()
+
+		if time.Since(started) >= reconnectStableAfter {
+			backoff = reconnectMinBackoff
+		}
+		ircLog.Info("reconnecting", "in", backoff)
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+
+		conn.mtx.Lock()
+		conn.reconnects++
+		reconnects.Inc()
+		conn.mtx.Unlock()
+	}
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > reconnectMaxBackoff {
+		backoff = reconnectMaxBackoff
+	}
+	return backoff
+}
+
+// serve processes the messages received on t until the connection fails.
+func serve(t Transport) error {
+	conn.mtx.RLock()
+	failed := conn.failed
+	conn.mtx.RUnlock()
+
+	for {
+		var raw string
+		var ok bool
+		select {
+		case err := <-t.Errors():
+			return err
+		case err := <-failed:
+			return err
+		case raw, ok = <-t.Messages():
+			if !ok {
+				return errMessagesClosed
+			}
+		}
+
+		if ircLog.Enabled(LevelDebug) {
+			ircLog.Debug("received", "line", redactLine(raw))
+		}
+		msg := parseMessage(raw)
+		if msg == nil {
+			continue // message could not be parsed
+		}
+		messagesReceived.WithLabelValues(msg.Command).Inc()
+
+		if msg.Command == irc.PONG {
+			continue
+		}
+
+		if msg.Command == irc.PING {
+			Post("PONG :" + msg.Trailing())
+			continue
+		}
+
+		if err := listenersRun(msg); err != nil {
+			ircLog.Warn("error processing message", "line", redactLine(raw), "err", err)
+		}
+	}
+}
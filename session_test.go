@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeTransport records all sent lines and delivers lines from its messages
+// channel.
+type fakeTransport struct {
+	messages chan string
+	errors   chan error
+	sent     chan string
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		messages: make(chan string),
+		errors:   make(chan error, 1),
+		sent:     make(chan string, 1000),
+	}
+}
+
+func (f *fakeTransport) Connect() error             { return nil }
+func (f *fakeTransport) Messages() <-chan string    { return f.messages }
+func (f *fakeTransport) Errors() <-chan error       { return f.errors }
+func (f *fakeTransport) Close(quitMsg string) error { return nil }
+func (f *fakeTransport) ID() string                 { return "fake" }
+
+func (f *fakeTransport) Send(line string) error {
+	if err := validateLine(line); err != nil {
+		return err
+	}
+	f.sent <- line
+	return nil
+}
+
+func TestServe(t *testing.T) {
+	ft := newFakeTransport()
+	setTransport(ft)
+	defer setTransport(nil)
+	withOutbound(t, 100)
+	// stays blocked on the replaced queue once the test is done
+	go outbound.run()
+
+	result := make(chan error)
+	go func() {
+		result <- serve(ft)
+	}()
+
+	ft.messages <- "PING :irc.example.com"
+	select {
+	case got := <-ft.sent:
+		if want := "PONG :irc.example.com"; got != want {
+			t.Errorf("sent %q in reply to PING, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no reply to PING")
+	}
+
+	wantErr := errors.New("connection reset")
+	connectionFailed(ft, wantErr)
+	select {
+	case err := <-result:
+		if err != wantErr {
+			t.Errorf("serve() = %v, want %v", err, wantErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve() did not return after the connection failed")
+	}
+}
+
+func TestInvalidLineKeepsConnection(t *testing.T) {
+	ft := newFakeTransport()
+	setTransport(ft)
+	defer setTransport(nil)
+	withOutbound(t, 100)
+	go outbound.run()
+
+	Post("PRIVMSG #test :Hello\n")
+	Post("PRIVMSG #test :still here")
+	select {
+	case got := <-ft.sent:
+		if want := "PRIVMSG #test :still here"; got != want {
+			t.Errorf("sent %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nothing sent after the invalid line")
+	}
+	conn.mtx.RLock()
+	defer conn.mtx.RUnlock()
+	select {
+	case err := <-conn.failed:
+		t.Errorf("invalid line was treated as a connection failure: %v", err)
+	default:
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	backoff := reconnectMinBackoff
+	for i := 0; i < 20; i++ {
+		backoff = nextBackoff(backoff)
+	}
+	if backoff != reconnectMaxBackoff {
+		t.Errorf("backoff = %v, want it capped at %v", backoff, reconnectMaxBackoff)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// maximum length of an IRC line including the trailing CRLF
+const ircLineLength = 512
+
+// used when our own prefix is not yet known: the ident is at most 10
+// characters (including a ~ for non-identd users), hostnames at most 63.
+const (
+	maxUserLength = 10
+	maxHostLength = 63
+)
+
+const ellipsis = "…"
+
+// the prefix (nick!user@host) under which other users see our messages
+var selfPrefix = struct {
+	mtx sync.Mutex
+	p   string
+}{}
+
+// runnerSelfPrefix learns our own prefix from the echo of our JOINs.
+func runnerSelfPrefix(ctx context.Context, parsed *Message) error {
+	if parsed.Command != irc.JOIN || parsed.Prefix == nil || !isMe(Nick(parsed)) {
+		return nil
+	}
+	if parsed.Prefix.User == "" || parsed.Prefix.Host == "" {
+		return nil
+	}
+
+	selfPrefix.mtx.Lock()
+	defer selfPrefix.mtx.Unlock()
+	selfPrefix.p = parsed.Prefix.String()
+	return nil
+}
+
+func selfPrefixLength() int {
+	selfPrefix.mtx.Lock()
+	defer selfPrefix.mtx.Unlock()
+	if selfPrefix.p != "" {
+		return len(selfPrefix.p)
+	}
+	return len(currentNick()) + len("!") + maxUserLength + len("@") + maxHostLength
+}
+
+// privmsgLimit returns how many bytes of payload fit into a PRIVMSG to
+// target, as it will be relayed by the server to the other users:
+// ":nick!user@host PRIVMSG target :payload\r\n"
+func privmsgLimit(target string) int {
+	overhead := len(":") + selfPrefixLength() + len(" PRIVMSG ") + len(target) + len(" :") + len("\r\n")
+	return ircLineLength - overhead
+}
+
+// splitMessage splits msg into lines of at most limit bytes, preferably at
+// word boundaries and never within a UTF-8 sequence. Line breaks in msg
+// always start a new line; empty lines are dropped. If maxLines is positive,
+// at most that many lines are returned and an ellipsis marks the truncation.
+func splitMessage(msg string, limit int, maxLines int) []string {
+	if limit < utf8.UTFMax {
+		limit = utf8.UTFMax
+	}
+
+	var lines []string
+	pieces := strings.FieldsFunc(msg, func(r rune) bool { return r == '\r' || r == '\n' })
+	for _, piece := range pieces {
+		for len(piece) > limit {
+			cut := splitPoint(piece, limit)
+			lines = append(lines, strings.TrimRight(piece[:cut], " "))
+			piece = strings.TrimLeft(piece[cut:], " ")
+		}
+		if piece != "" {
+			lines = append(lines, piece)
+		}
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "")
+	}
+
+	if maxLines > 0 && len(lines) > maxLines {
+		lines = lines[:maxLines]
+		last := lines[maxLines-1]
+		if len(last)+len(ellipsis) > limit {
+			last = strings.TrimRight(last[:splitPoint(last, limit-len(ellipsis))], " ")
+		}
+		lines[maxLines-1] = last + ellipsis
+	}
+	return lines
+}
+
+// splitPoint returns where to split s so that the first part is at most n
+// bytes long. It prefers the last space, unless that would leave a very short
+// line.
+func splitPoint(s string, n int) int {
+	cut := runeBoundary(s, n)
+	if space := strings.LastIndexByte(s[:cut], ' '); space > n/2 {
+		cut = space
+	}
+	return cut
+}
+
+// runeBoundary returns the largest index <= n at which s can be cut without
+// splitting a rune.
+func runeBoundary(s string, n int) int {
+	if n >= len(s) {
+		return len(s)
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return n
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tcs := []struct {
+		Msg      string
+		Limit    int
+		MaxLines int
+		Want     []string
+	}{
+		{"short", 10, 0, []string{"short"}},
+		{"", 10, 0, []string{""}},
+		{"the quick brown fox jumps", 10, 0, []string{"the quick", "brown fox", "jumps"}},
+		{"abcdefghijklmnop", 10, 0, []string{"abcdefghij", "klmnop"}},
+		// a split at the space would leave a very short line
+		{"a bcdefghijklmnop", 10, 0, []string{"a bcdefghi", "jklmnop"}},
+		// ä is two bytes, the 5th one must not be split
+		{"ääääää", 9, 0, []string{"ääää", "ää"}},
+		{"the quick brown fox jumps", 10, 2, []string{"the quick", "brown" + ellipsis}},
+		{"the quick brown fox jumps", 10, 3, []string{"the quick", "brown fox", "jumps"}},
+		// line breaks never end up in a line, and split before the length does
+		{"one\ntwo\r\nthree", 10, 0, []string{"one", "two", "three"}},
+		{"a\n\nb\r", 10, 0, []string{"a", "b"}},
+		{"hi\nthe quick brown fox", 10, 0, []string{"hi", "the quick", "brown fox"}},
+		{"one\ntwo\nthree", 10, 2, []string{"one", "two" + ellipsis}},
+		{"\r\n", 10, 0, []string{""}},
+	}
+
+	for _, tc := range tcs {
+		got := splitMessage(tc.Msg, tc.Limit, tc.MaxLines)
+		if !reflect.DeepEqual(got, tc.Want) {
+			t.Errorf("splitMessage(%q, %d, %d) = %q, want %q", tc.Msg, tc.Limit, tc.MaxLines, got, tc.Want)
+		}
+	}
+}
+
+func TestSplitMessageLimits(t *testing.T) {
+	msg := strings.Repeat("Grüße aus dem Chaostreff 🕖 ", 100)
+	for limit := 4; limit < 100; limit++ {
+		for _, line := range splitMessage(msg, limit, 0) {
+			if len(line) > limit {
+				t.Errorf("splitMessage(…, %d) returned line of length %d: %q", limit, len(line), line)
+			}
+			if !utf8.ValidString(line) {
+				t.Errorf("splitMessage(…, %d) returned invalid UTF-8: %q", limit, line)
+			}
+		}
+	}
+}
+
+func TestPrivmsgLimit(t *testing.T) {
+	selfPrefix.p = "frank!bot@robust/0x1"
+	defer func() { selfPrefix.p = "" }()
+
+	// :frank!bot@robust/0x1 PRIVMSG #chaos-hd :…\r\n
+	if got, want := privmsgLimit("#chaos-hd"), 512-1-20-9-9-2-2; got != want {
+		t.Errorf("privmsgLimit(#chaos-hd) = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stateVersion is the version of the export format. Increase it for
+// incompatible changes and teach importState to convert older versions.
+const stateVersion = 1
+
+// exportedState is everything frank persists, in a form meant to be read and
+// edited by humans.
+type exportedState struct {
+	Version  int       `json:"version"`
+	Exported time.Time `json:"exported"`
+
+	// thing → karma
+	Karma map[string]int `json:"karma"`
+	// channel → nick or hostmask → last seen
+	LastSeen map[string]map[string]time.Time `json:"last_seen"`
+	// URL → when it was posted
+	RSSSeen map[string]time.Time `json:"rss_seen"`
+	// oldest first
+	LinkCache []linkCacheEntry `json:"link_cache"`
+	// sorted by mask
+	Ignores []ignoreEntry `json:"ignores"`
+	// admin actions, oldest first
+	Audit []auditEntry `json:"audit"`
+	// gob file of an earlier version → when it was imported, see
+	// migrateGobFiles
+	Migrated map[string]time.Time `json:"migrated"`
+}
+
+// exportState reads all state from s.
+func exportState(s Store) (*exportedState, error) {
+	st := &exportedState{
+		Version:  stateVersion,
+		Exported: time.Now(),
+		Karma:    make(map[string]int),
+		LastSeen: make(map[string]map[string]time.Time),
+		RSSSeen:  make(map[string]time.Time),
+		// [] instead of null in the JSON output
+		LinkCache: []linkCacheEntry{},
+		Ignores:   []ignoreEntry{},
+		Audit:     []auditEntry{},
+		Migrated:  make(map[string]time.Time),
+	}
+	err := s.View(func(tx Tx) error {
+		err := tx.ForEach(karmaNamespace, func(key string, value []byte) error {
+			var karma int
+			if err := json.Unmarshal(value, &karma); err != nil {
+				return fmt.Errorf("karma of %q: %v", key, err)
+			}
+			st.Karma[key] = karma
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.ForEach(lastSeenNamespace, func(key string, value []byte) error {
+			channel, nick, err := splitLastSeenKey(key)
+			if err != nil {
+				return err
+			}
+			var last time.Time
+			if err := json.Unmarshal(value, &last); err != nil {
+				return fmt.Errorf("last-seen of %q: %v", key, err)
+			}
+			if st.LastSeen[channel] == nil {
+				st.LastSeen[channel] = make(map[string]time.Time)
+			}
+			st.LastSeen[channel][nick] = last
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.ForEach(rssSeenNamespace, func(key string, value []byte) error {
+			var posted time.Time
+			if err := json.Unmarshal(value, &posted); err != nil {
+				return fmt.Errorf("RSS item %q: %v", key, err)
+			}
+			st.RSSSeen[key] = posted
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.ForEach(linkCacheNamespace, func(key string, value []byte) error {
+			var e linkCacheEntry
+			if err := json.Unmarshal(value, &e); err != nil {
+				return fmt.Errorf("link cache entry %q: %v", key, err)
+			}
+			st.LinkCache = append(st.LinkCache, e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.ForEach(ignoreNamespace, func(key string, value []byte) error {
+			var e ignoreEntry
+			if err := json.Unmarshal(value, &e); err != nil {
+				return fmt.Errorf("ignore %q: %v", key, err)
+			}
+			st.Ignores = append(st.Ignores, e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.ForEach(auditNamespace, func(key string, value []byte) error {
+			var e auditEntry
+			if err := json.Unmarshal(value, &e); err != nil {
+				return fmt.Errorf("audit entry %s: %v", key, err)
+			}
+			st.Audit = append(st.Audit, e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.ForEach(metaNamespace, func(key string, value []byte) error {
+			if !strings.HasPrefix(key, migratedPrefix) {
+				return nil
+			}
+			var migrated time.Time
+			if err := json.Unmarshal(value, &migrated); err != nil {
+				return fmt.Errorf("migration marker %q: %v", key, err)
+			}
+			st.Migrated[strings.TrimPrefix(key, migratedPrefix)] = migrated
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(st.LinkCache, func(i, j int) bool {
+		return st.LinkCache[i].Date.Before(st.LinkCache[j].Date)
+	})
+	return st, nil
+}
+
+// importState replaces all state in s with st.
+func importState(s Store, st *exportedState) error {
+	if st.Version == 0 {
+		return fmt.Errorf("version missing")
+	}
+	if st.Version > stateVersion {
+		return fmt.Errorf("version %d is newer than the supported version %d", st.Version, stateVersion)
+	}
+	if len(st.LinkCache) > cacheSize {
+		st.LinkCache = st.LinkCache[len(st.LinkCache)-cacheSize:]
+	}
+
+	return s.Update(func(tx Tx) error {
+		for _, namespace := range []string{karmaNamespace, lastSeenNamespace, rssSeenNamespace, linkCacheNamespace, ignoreNamespace, auditNamespace, metaNamespace} {
+			if err := clearNamespace(tx, namespace); err != nil {
+				return err
+			}
+		}
+
+		for thing, karma := range st.Karma {
+			if err := putJSON(tx, karmaNamespace, thing, karma); err != nil {
+				return err
+			}
+		}
+		for channel, c := range st.LastSeen {
+			for nick, last := range c {
+				if err := putJSON(tx, lastSeenNamespace, lastSeenKey(channel, nick), last); err != nil {
+					return err
+				}
+			}
+		}
+		for url, posted := range st.RSSSeen {
+			if err := putJSON(tx, rssSeenNamespace, url, posted); err != nil {
+				return err
+			}
+		}
+		for i, e := range st.LinkCache {
+			if err := putJSON(tx, linkCacheNamespace, fmt.Sprintf("%03d", i), e); err != nil {
+				return err
+			}
+		}
+		for _, e := range st.Ignores {
+			mask, err := normalizeIgnoreMask(e.Mask)
+			if err != nil {
+				return err
+			}
+			e.Mask = mask
+			if err := putJSON(tx, ignoreNamespace, e.Mask, e); err != nil {
+				return err
+			}
+		}
+		var last int64
+		for _, e := range st.Audit {
+			// the same keys audit would have used
+			seq := e.Time.UnixNano()
+			if seq <= last {
+				seq = last + 1
+			}
+			last = seq
+			if err := putJSON(tx, auditNamespace, fmt.Sprintf("%020d", seq), e); err != nil {
+				return err
+			}
+		}
+		for file, migrated := range st.Migrated {
+			if err := putJSON(tx, metaNamespace, migratedPrefix+file, migrated); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func clearNamespace(tx Tx, namespace string) error {
+	var keys []string
+	err := tx.ForEach(namespace, func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tx.Delete(namespace, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runSubcommand implements “frank export [file]” and “frank import [file]”,
+// which read from stdin and write to stdout if no file is given. frank must
+// not be running at the same time, as it keeps the state file locked.
+func runSubcommand(args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("too many arguments: %q", args)
+	}
+	var path string
+	if len(args) > 1 {
+		path = args[1]
+	}
+
+	switch args[0] {
+	case "export":
+		setupStore()
+		defer store.Close()
+		st, err := exportState(store)
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(st, "", "\t")
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if path == "" {
+			_, err = os.Stdout.Write(b)
+			return err
+		}
+		return writeAtomically(path, func(w io.Writer) error {
+			_, err := w.Write(b)
+			return err
+		})
+
+	case "import":
+		var b []byte
+		var err error
+		if path == "" {
+			b, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			b, err = ioutil.ReadFile(path)
+		}
+		if err != nil {
+			return err
+		}
+		var st exportedState
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&st); err != nil {
+			return err
+		}
+
+		setupStore()
+		defer store.Close()
+		if err := importState(store, &st); err != nil {
+			return err
+		}
+		stateLog.Info("imported state", "karma", len(st.Karma), "last_seen_channels", len(st.LastSeen),
+			"rss_items", len(st.RSSSeen), "cached_links", len(st.LinkCache), "ignores", len(st.Ignores))
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command %q, known commands are export and import", args[0])
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	want := &exportedState{
+		Version:  stateVersion,
+		Karma:    map[string]int{"frank": 10000, "go": -3},
+		LastSeen: map[string]map[string]time.Time{"#chaos-hd": {"alice": now, "bob!b@example.net": now}},
+		RSSSeen:  map[string]time.Time{"https://example.net/feed/1": now},
+		LinkCache: []linkCacheEntry{
+			{"https://example.net/", "Example", now.Add(-time.Hour)},
+			{"", "Example", now},
+		},
+		Ignores: []ignoreEntry{
+			{Mask: "otherbot!*@*", Added: now, By: "xeen"},
+			{Mask: "spammer!*@*", Added: now, By: "xeen", Expires: now.Add(time.Hour), Reason: "karma spam"},
+		},
+		Audit: []auditEntry{
+			{Time: now, Nick: "xeen", Hostmask: "x@example.net", Action: "ignore", Args: []string{"otherbot!*@*"}},
+			// the clock did not advance
+			{Time: now, Nick: "xeen", Hostmask: "x@example.net", Action: "join", Args: []string{"#test"}},
+		},
+		Migrated: map[string]time.Time{"karma": now},
+	}
+
+	s := newMemoryStore()
+	// existing state is replaced
+	if err := s.Update(func(tx Tx) error { return putJSON(tx, karmaNamespace, "old", 1) }); err != nil {
+		t.Fatal(err)
+	}
+	// round trip through JSON, like frank export | frank import would
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st exportedState
+	if err := json.Unmarshal(b, &st); err != nil {
+		t.Fatal(err)
+	}
+	if err := importState(s, &st); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := exportState(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(got.Exported) > time.Minute {
+		t.Errorf("exported at %v, want now", got.Exported)
+	}
+	got.Exported = want.Exported
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("exportState() = %+v, want %+v", got, want)
+	}
+}
+
+func TestImportVersion(t *testing.T) {
+	for _, version := range []int{0, stateVersion + 1} {
+		st := &exportedState{Version: version, Karma: map[string]int{"go": 1}}
+		if err := importState(newMemoryStore(), st); err == nil {
+			t.Errorf("importState accepted version %d", version)
+		}
+	}
+}
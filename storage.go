@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var stateLog = newLogger("state")
+
+// Store is a key/value store in which every module uses its own namespace,
+// e.g. "karma". Implementations must be safe for concurrent use.
+type Store interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(Tx) error) error
+	// Update runs fn in a read-write transaction. If fn returns an error,
+	// none of its changes are applied.
+	Update(fn func(Tx) error) error
+	Close() error
+}
+
+// Tx is a transaction on a Store. It must not be used after the function it
+// was passed to has returned.
+type Tx interface {
+	// Get returns the value of key in namespace, or nil if there is none.
+	// The value must not be modified.
+	Get(namespace, key string) []byte
+	Put(namespace, key string, value []byte) error
+	Delete(namespace, key string) error
+	// ForEach calls fn for all keys in namespace in lexical order. fn must
+	// not modify the namespace.
+	ForEach(namespace string, fn func(key string, value []byte) error) error
+}
+
+// getJSON decodes the value of key into v. found is false if there is no such
+// key.
+func getJSON(tx Tx, namespace, key string, v interface{}) (found bool, err error) {
+	b := tx.Get(namespace, key)
+	if b == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return true, fmt.Errorf("%s/%s: %v", namespace, key, err)
+	}
+	return true, nil
+}
+
+func putJSON(tx Tx, namespace, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Put(namespace, key, b)
+}
+
+// boltStore keeps one bucket per namespace in a bbolt database file.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) View(fn func(Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStore) Update(fn func(Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Get(namespace, key string) []byte {
+	b := t.tx.Bucket([]byte(namespace))
+	if b == nil {
+		return nil
+	}
+	return b.Get([]byte(key))
+}
+
+func (t boltTx) Put(namespace, key string, value []byte) error {
+	b, err := t.tx.CreateBucketIfNotExists([]byte(namespace))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), value)
+}
+
+func (t boltTx) Delete(namespace, key string) error {
+	b := t.tx.Bucket([]byte(namespace))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
+
+func (t boltTx) ForEach(namespace string, fn func(key string, value []byte) error) error {
+	b := t.tx.Bucket([]byte(namespace))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
+
+// memoryStore keeps everything in memory. It is used when no state file is
+// configured and in tests.
+type memoryStore struct {
+	mtx sync.RWMutex
+	m   map[string]map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{m: make(map[string]map[string][]byte)}
+}
+
+func (s *memoryStore) View(fn func(Tx) error) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return fn(&memoryTx{s: s})
+}
+
+func (s *memoryStore) Update(fn func(Tx) error) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	tx := &memoryTx{s: s, writable: true, changes: make(map[string]map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for namespace, changes := range tx.changes {
+		if s.m[namespace] == nil {
+			s.m[namespace] = make(map[string][]byte)
+		}
+		for key, value := range changes {
+			if value == nil {
+				delete(s.m[namespace], key)
+			} else {
+				s.m[namespace][key] = value
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// memoryTx records changes separately until the transaction is committed. A
+// nil value in changes marks a deleted key.
+type memoryTx struct {
+	s        *memoryStore
+	writable bool
+	changes  map[string]map[string][]byte
+}
+
+var errReadOnly = errors.New("read-only transaction")
+
+func (t *memoryTx) Get(namespace, key string) []byte {
+	if value, ok := t.changes[namespace][key]; ok {
+		return value
+	}
+	return t.s.m[namespace][key]
+}
+
+func (t *memoryTx) Put(namespace, key string, value []byte) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	if t.changes[namespace] == nil {
+		t.changes[namespace] = make(map[string][]byte)
+	}
+	t.changes[namespace][key] = append([]byte{}, value...)
+	return nil
+}
+
+func (t *memoryTx) Delete(namespace, key string) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	if t.changes[namespace] == nil {
+		t.changes[namespace] = make(map[string][]byte)
+	}
+	t.changes[namespace][key] = nil
+	return nil
+}
+
+func (t *memoryTx) ForEach(namespace string, fn func(key string, value []byte) error) error {
+	var keys []string
+	for key := range t.s.m[namespace] {
+		if _, ok := t.changes[namespace][key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	for key, value := range t.changes[namespace] {
+		if value != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, t.Get(namespace, key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// store is where modules persist their state. It is replaced by setupStore
+// before any listener runs.
+var store Store = newMemoryStore()
+
+// setupStore opens the configured state file.
+func setupStore() {
+	path := currentConfig().StateFile
+	if path == "" {
+		stateLog.Warn("no state_file configured, state will be lost on restart")
+	} else {
+		s, err := openBoltStore(path)
+		if err != nil {
+			stateLog.Fatal("could not open the state file", "err", err)
+		}
+		store = s
+	}
+}
+
+// loadState imports the gob files written by earlier versions and loads the
+// state modules keep in memory. Without a state file there is nothing to
+// import into: the gob files would be renamed and their contents lost.
+func loadState() {
+	if currentConfig().StateFile != "" {
+		if err := migrateGobFiles(store, "."); err != nil {
+			stateLog.Fatal("could not migrate old state", "err", err)
+		}
+	}
+	loadLastSeen()
+	loadLinkCache()
+	recent.load()
+	loadIgnores()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testStores(t *testing.T) map[string]Store {
+	bs, err := openBoltStore(filepath.Join(t.TempDir(), "frank.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bs.Close() })
+	return map[string]Store{
+		"bolt":   bs,
+		"memory": newMemoryStore(),
+	}
+}
+
+func TestStore(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			err := s.Update(func(tx Tx) error {
+				for _, key := range []string{"b", "a", "c"} {
+					if err := putJSON(tx, "test", key, key+"-value"); err != nil {
+						return err
+					}
+				}
+				if err := putJSON(tx, "other", "a", 42); err != nil {
+					return err
+				}
+				return tx.Delete("test", "c")
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A failing transaction must not change anything.
+			errFail := errors.New("fail")
+			err = s.Update(func(tx Tx) error {
+				if err := tx.Put("test", "d", []byte(`"d-value"`)); err != nil {
+					return err
+				}
+				if err := tx.Delete("test", "a"); err != nil {
+					return err
+				}
+				return errFail
+			})
+			if err != errFail {
+				t.Fatalf("Update returned %v, want %v", err, errFail)
+			}
+
+			err = s.View(func(tx Tx) error {
+				got := make(map[string]string)
+				var order []string
+				err := tx.ForEach("test", func(key string, value []byte) error {
+					order = append(order, key)
+					got[key] = string(value)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				want := map[string]string{"a": `"a-value"`, "b": `"b-value"`}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("namespace test contains %v, want %v", got, want)
+				}
+				if want := []string{"a", "b"}; !reflect.DeepEqual(order, want) {
+					t.Errorf("ForEach visited %q, want %q", order, want)
+				}
+
+				var n int
+				if found, err := getJSON(tx, "other", "a", &n); err != nil || !found || n != 42 {
+					t.Errorf(`getJSON("other", "a") = %d, %v, %v, want 42, true, nil`, n, found, err)
+				}
+				if found, err := getJSON(tx, "other", "missing", &n); err != nil || found {
+					t.Errorf(`getJSON("other", "missing") = %v, %v, want false, nil`, found, err)
+				}
+				if v := tx.Get("nonexistent", "a"); v != nil {
+					t.Errorf("Get on a nonexistent namespace returned %q", v)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestKarmaVote(t *testing.T) {
+	old := store
+	defer func() { store = old }()
+	store = newMemoryStore()
+
+	if k, err := karmaGet("frank"); err != nil || k != 9999 {
+		t.Errorf(`karmaGet("frank") = %d, %v, want 9999, nil`, k, err)
+	}
+	for i := 0; i < 3; i++ {
+		karmaVote("go", 1)
+	}
+	if k, err := karmaVote("go", -1); err != nil || k != 2 {
+		t.Errorf(`karmaVote("go", -1) = %d, %v, want 2, nil`, k, err)
+	}
+	if k, err := karmaGet("go"); err != nil || k != 2 {
+		t.Errorf(`karmaGet("go") = %d, %v, want 2, nil`, k, err)
+	}
+}
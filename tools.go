@@ -1,27 +1,30 @@
 package main
 
 import (
-	"log"
-	"regexp"
 	"strings"
-
-	"gopkg.in/sorcix/irc.v2"
 )
 
+// Post queues msg for sending. Lines are sent in order of priority and
+// subject to flood control, see outQueue.
 func Post(msg string) {
-	log.Printf(">>> %s", msg)
+	outbound.push(msg)
+}
 
-	if err := session.PostMessage(msg); err != nil {
-		log.Fatalf("Could not post message to RobustIRC: %v", err)
-	}
+// postHigh queues line before all chatter, like protocol commands.
+func postHigh(line string) {
+	outbound.pushPriority(line, priorityHigh, "")
 }
 
+// Privmsg sends msg to user (or channel), split into as many lines as
+// necessary to not exceed the IRC line length limit.
 func Privmsg(user string, msg string) {
-	Post("PRIVMSG " + user + " :" + msg)
+	for _, line := range splitMessage(msg, privmsgLimit(user), currentConfig().MaxLines) {
+		Post("PRIVMSG " + user + " :" + line)
+	}
 }
 
-func IsPrivateQuery(p *irc.Message) bool {
-	return p.Command == "PRIVMSG" && Target(p) == *nick
+func IsPrivateQuery(p *Message) bool {
+	return p.Command == "PRIVMSG" && isMe(Target(p))
 }
 
 func Join(channel string) {
@@ -32,22 +35,33 @@ func Join(channel string) {
 		return
 	}
 
-	log.Printf("joining #%s", channel)
-	if *nickserv_password != "" {
-		Privmsg("chanserv", "invite #"+channel)
+	adminLog.Info("joining", "channel", "#"+channel)
+	if currentConfig().NickservPassword != "" {
+		// in the same lane as the JOIN, which must not overtake it
+		postHigh("PRIVMSG chanserv :invite #" + channel)
 	}
 	Post("JOIN #" + channel)
 }
 
-func Nick(p *irc.Message) string {
+func Part(channel string) {
+	channel = strings.TrimSpace(channel)
+	if channel == "" {
+		return
+	}
+
+	adminLog.Info("parting", "channel", channel)
+	Post("PART " + channel)
+}
+
+func Nick(p *Message) string {
 	return p.Prefix.Name
 }
 
-func Hostmask(p *irc.Message) string {
+func Hostmask(p *Message) string {
 	return p.Prefix.Host
 }
 
-func Target(parsed *irc.Message) string {
+func Target(parsed *Message) string {
 	p := parsed.Params
 	if len(p) == 0 {
 		return ""
@@ -56,21 +70,6 @@ func Target(parsed *irc.Message) string {
 	}
 }
 
-func IsNickAdmin(p *irc.Message) bool {
-	nick := Nick(p)
-	admins := regexp.MustCompile("\\s+").Split(*admins, -1)
-
-	for _, admin := range admins {
-		if *verbose {
-			log.Printf("debug admin: checking if |%s|==|%s| (=%v)", nick, admin, nick == admin)
-		}
-		if nick == admin {
-			return true
-		}
-	}
-	return false
-}
-
 func IsIn(needle string, haystack []string) bool {
 	for _, s := range haystack {
 		if s == needle {
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
@@ -12,38 +12,46 @@ import (
 	_ "github.com/lib/pq"
 )
 
+var topicChangerLog = newLogger("topicchanger")
+
 // I would prefer 🕖, but it’s not available in most fonts
 const RobotBlockIdentifier = "ꜰ"
 
+var topicChangerModule = &Module{
+	Name:        "topicchanger",
+	Description: "keeps the next event in the topic",
+}
+
 func TopicChanger() {
 	for {
-		Post("TOPIC #chaos-hd") // TODO: configurable channel
+		for _, channel := range enabledChannels("topicchanger") {
+			Post("TOPIC " + channel)
+		}
 		time.Sleep(5 * time.Minute)
 	}
 }
 
-func runnerTopicChanger(msg *irc.Message) error {
+func runnerTopicChanger(ctx context.Context, msg *Message) error {
 	var topic string
 
-	channel := "#chaos-hd" // TODO: configurable channel
-
+	// listenersRun already skipped channels in which we are disabled
 	switch msg.Command {
 	// A user changed the topic
 	case irc.TOPIC:
-		if len(msg.Params) < 1 || msg.Params[0] != channel {
+		if len(msg.Params) < 1 {
 			return nil
 		}
-		return updateTopic(channel, msg.Trailing())
+		return updateTopic(msg.Params[0], msg.Trailing())
 
 	// We received a reply to our periodic TOPIC command.
 	case irc.RPL_TOPIC:
 		topic = msg.Trailing()
 		fallthrough
 	case irc.RPL_NOTOPIC:
-		if len(msg.Params) < 2 || msg.Params[1] != channel {
+		if len(msg.Params) < 2 {
 			return nil
 		}
-		return updateTopic(channel, topic)
+		return updateTopic(msg.Params[1], topic)
 	}
 
 	return nil
@@ -76,7 +84,7 @@ func updateTopic(channel, currentTopic string) error {
 		return err
 	}
 	if strings.TrimSpace(currentTopic) != strings.TrimSpace(newTopic) {
-		log.Printf("updating topic from %q to %q", currentTopic, newTopic)
+		topicChangerLog.Info("updating topic", "from", currentTopic, "to", newTopic)
 		Post("TOPIC " + channel + " :" + newTopic)
 	}
 	return nil
@@ -151,7 +159,7 @@ WHERE termine.date >= NOW()::date
 ORDER BY termine.date ASC
 LIMIT 1
 `
-	db, err := sql.Open("postgres", "dbname=nnev user=anon host=/var/run/postgresql sslmode=disable")
+	db, err := sql.Open("postgres", currentConfig().TopicChanger.DSN)
 	if err != nil {
 		return nil, err
 	}
@@ -168,8 +176,8 @@ LIMIT 1
 		return nil, err
 	}
 
-	if *verbose {
-		log.Printf("event from SQL: %#v", e)
+	if topicChangerLog.Enabled(LevelDebug) {
+		topicChangerLog.Debug("event from SQL", "event", fmt.Sprintf("%#v", e))
 	}
 
 	return &e, nil
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robustirc/bridge/robustsession"
+)
+
+// Transport is a connection to an IRC network. All lines are raw IRC lines
+// without the trailing CRLF.
+type Transport interface {
+	// Connect establishes the connection. It must be called exactly once
+	// before any other method.
+	Connect() error
+	// Send transmits a single line to the network. It returns
+	// errInvalidLine without sending anything if line cannot be sent.
+	Send(line string) error
+	// Messages returns the lines received from the network.
+	Messages() <-chan string
+	// Errors returns errors after which the connection is unusable.
+	Errors() <-chan error
+	// Close terminates the connection, using quitMsg as reason if the
+	// transport supports it.
+	Close(quitMsg string) error
+	// ID identifies the connection in logs, e.g. the RobustIRC session id.
+	ID() string
+}
+
+// errInvalidLine is returned by Send for lines which would break the
+// protocol. The connection is still usable afterwards.
+var errInvalidLine = errors.New("line must not contain CR or LF")
+
+func validateLine(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return errInvalidLine
+	}
+	return nil
+}
+
+// newTransport returns the transport selected in the config.
+func newTransport(c *Config) (Transport, error) {
+	switch c.Transport {
+	case "", "robustirc":
+		return &robustTransport{network: c.Network, tlsCAFile: c.TLSCAFile}, nil
+	case "irc":
+		return &ircTransport{
+			server:        c.Server,
+			useTLS:        c.TLS,
+			tlsCAFile:     c.TLSCAFile,
+			tlsClientCert: c.TLSClientCert,
+			tlsClientKey:  c.TLSClientKey,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", c.Transport)
+	}
+}
+
+// RobustIRC ///////////////////////////////////////////////////////////
+
+type robustTransport struct {
+	network   string
+	tlsCAFile string
+
+	session *robustsession.RobustSession
+}
+
+func (r *robustTransport) Connect() error {
+	s, err := robustsession.Create(r.network, r.tlsCAFile)
+	if err != nil {
+		return fmt.Errorf("could not create RobustIRC session: %v", err)
+	}
+	r.session = s
+	return nil
+}
+
+func (r *robustTransport) Send(line string) error {
+	if err := validateLine(line); err != nil {
+		return err
+	}
+	return r.session.PostMessage(line)
+}
+
+func (r *robustTransport) Messages() <-chan string {
+	return r.session.Messages
+}
+
+func (r *robustTransport) Errors() <-chan error {
+	return r.session.Errors
+}
+
+func (r *robustTransport) Close(quitMsg string) error {
+	return r.session.Delete(quitMsg)
+}
+
+func (r *robustTransport) ID() string {
+	return "RobustSession " + r.session.SessionId()
+}
+
+// plain IRC ///////////////////////////////////////////////////////////
+
+// how long a single write to the server may take
+const ircWriteTimeout = 30 * time.Second
+
+// how long the server may stay silent before the connection is considered
+// dead. Our keepalive PINGs ensure that the server replies at least once a
+// minute.
+const ircReadTimeout = 5 * time.Minute
+
+type ircTransport struct {
+	server    string // host:port
+	useTLS    bool
+	tlsCAFile string
+	// optional client certificate, e.g. for SASL EXTERNAL
+	tlsClientCert string
+	tlsClientKey  string
+
+	conn     net.Conn
+	writeMtx sync.Mutex
+	messages chan string
+	errors   chan error
+	done     chan struct{}
+	closed   sync.Once
+}
+
+func (t *ircTransport) tlsConfig() (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(t.server)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{ServerName: host}
+	if t.tlsCAFile != "" {
+		pem, err := ioutil.ReadFile(t.tlsCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.tlsCAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if t.tlsClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(t.tlsClientCert, t.tlsClientKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (t *ircTransport) Connect() error {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: time.Minute}
+
+	var conn net.Conn
+	var err error
+	if t.useTLS {
+		cfg, cfgErr := t.tlsConfig()
+		if cfgErr != nil {
+			return cfgErr
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", t.server, cfg)
+	} else {
+		conn, err = dialer.Dial("tcp", t.server)
+	}
+	if err != nil {
+		return fmt.Errorf("could not connect to %s: %v", t.server, err)
+	}
+
+	t.conn = conn
+	t.messages = make(chan string)
+	t.errors = make(chan error, 1)
+	t.done = make(chan struct{})
+	go t.read()
+	return nil
+}
+
+func (t *ircTransport) read() {
+	// IRCv3 allows for 8191 bytes of tags in addition to the 512 bytes of
+	// the message itself.
+	r := bufio.NewReaderSize(t.conn, 8191+512)
+	for {
+		t.conn.SetReadDeadline(time.Now().Add(ircReadTimeout))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.fail(err)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		select {
+		case t.messages <- line:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// fail reports err unless an error was already reported.
+func (t *ircTransport) fail(err error) {
+	select {
+	case t.errors <- err:
+	default:
+	}
+}
+
+func (t *ircTransport) Send(line string) error {
+	if err := validateLine(line); err != nil {
+		return err
+	}
+
+	t.writeMtx.Lock()
+	defer t.writeMtx.Unlock()
+
+	t.conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+	if _, err := t.conn.Write([]byte(line + "\r\n")); err != nil {
+		t.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (t *ircTransport) Messages() <-chan string {
+	return t.messages
+}
+
+func (t *ircTransport) Errors() <-chan error {
+	return t.errors
+}
+
+func (t *ircTransport) Close(quitMsg string) error {
+	var err error
+	t.closed.Do(func() {
+		// best effort, the server might be gone already
+		t.Send("QUIT :" + quitMsg)
+		close(t.done)
+		err = t.conn.Close()
+	})
+	return err
+}
+
+func (t *ircTransport) ID() string {
+	return fmt.Sprintf("IRC connection %s → %s", t.conn.LocalAddr(), t.conn.RemoteAddr())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIrcTransport(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(":irc.example.com 001 frank :Welcome\r\nPING :123\r\n"))
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			received <- scanner.Text()
+		}
+		close(received)
+	}()
+
+	tr, err := newTransport(&Config{Transport: "irc", Server: ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{":irc.example.com 001 frank :Welcome", "PING :123"} {
+		select {
+		case got := <-tr.Messages():
+			if got != want {
+				t.Errorf("received %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	if err := tr.Send("NICK frank"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Send("PRIVMSG #test :a\r\nQUIT"); err != errInvalidLine {
+		t.Errorf("Send() of a line containing CRLF = %v, want errInvalidLine", err)
+	}
+	if err := tr.Close("bye"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for line := range received {
+		got = append(got, line)
+	}
+	if want := "NICK frank\nQUIT :bye"; strings.Join(got, "\n") != want {
+		t.Errorf("server received %q, want %q", got, want)
+	}
+
+	select {
+	case <-tr.Errors():
+	case <-time.After(5 * time.Second):
+		t.Errorf("no error reported after the connection was closed")
+	}
+}
@@ -4,22 +4,27 @@ import (
 	"bufio"
 	"bytes"
 	"compress/zlib"
+	"context"
 	_ "crypto/sha512"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/charset"
 	"golang.org/x/text/transform"
-	"gopkg.in/sorcix/irc.v2"
 )
 
+var urifindLog = newLogger("urifind")
+
 // how many URLs can the cache store
 const cacheSize = 500
 
@@ -40,8 +45,6 @@ const titleMaxAllowedLength = 500
 // (control chars) are matched.
 var whitespaceRegex = regexp.MustCompile(`[\s\0\p{Cf}\p{Cc}]+`)
 
-var ignoreDomainsRegex = regexp.MustCompile(`^http://p\.nnev\.de`)
-
 var noSpoilerRegex = regexp.MustCompile(`(?i)(don't|no|kein|nicht) *spoiler`)
 
 // extract data from a PDF's document information dictionary
@@ -49,29 +52,12 @@ var pdfAuthorRegex = regexp.MustCompile(`/Author\(([^)]+?)\)`)
 var pdfTitleRegex = regexp.MustCompile(`/Title\(([^)]+?)\)`)
 var pdfSubjectRegex = regexp.MustCompile(`/Subject\(([^)]+?)\)`)
 
-// blacklist pointless titles /////////////////////////////////////////
-var pointlessTitles = []string{"",
-	"imgur: the simple image sharer",
-	"Fefes Blog",
-	"Gmane Loom",
-	"i3 - A better tiling and dynamic window manager",
-	"i3 - improved tiling wm",
-	"IT-News, c't, iX, Technology Review, Telepolis | heise online",
-	"debian Pastezone",
-	"Index of /docs/",
-	"NoName e.V. pastebin",
-	"Nopaste - powered by project-mindstorm IT Services",
-	"Diff NoName e.V. pastebin",
-	"pr0gramm.com",
-	"Google"}
-
-func runnerUrifind(parsed *irc.Message) error {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("MEGA-WTF:pkg: %v", r)
-		}
-	}()
+var urifindModule = &Module{
+	Name:        "urifind",
+	Description: "posts the titles of links. I won’t spoiler URLs if you add “no spoiler” to your message",
+}
 
+func runnerUrifind(ctx context.Context, parsed *Message) error {
 	if parsed.Command != "PRIVMSG" {
 		return nil
 	}
@@ -79,7 +65,7 @@ func runnerUrifind(parsed *irc.Message) error {
 	msg := parsed.Trailing()
 
 	if noSpoilerRegex.MatchString(msg) {
-		log.Printf("not spoilering this line: %s", msg)
+		urifindLog.Debug("not spoilering this line", "line", msg)
 		return nil
 	}
 
@@ -91,7 +77,7 @@ func runnerUrifind(parsed *irc.Message) error {
 		}
 
 		if cp := cacheGetByUrl(url); cp != nil {
-			log.Printf("using cache for URL: %s", cp.url)
+			urifindLog.Debug("using cache", "url", cp.url)
 			ago := cacheGetTimeAgo(cp)
 			postTitle(parsed, cp.title, "cached "+ago+" ago")
 			// Hack: add title to the cache again so we can correctly check
@@ -104,25 +90,39 @@ func runnerUrifind(parsed *irc.Message) error {
 			continue
 		}
 
-		go func(url string) {
-			if ignoreDomainsRegex.MatchString(url) {
-				log.Printf("ignoring this URL: %s", url)
+		url := url // copy
+		Spawn(ctx, "urifind title", 20*time.Second, func(ctx context.Context) {
+			c := currentConfig()
+			if re := c.Urifind.ignoreDomainsRegex; re != nil && re.MatchString(url) {
+				urifindLog.Debug("ignoring URL", "url", url)
 				return
 			}
 
-			log.Printf("testing URL: %s", url)
+			urifindLog.Debug("testing URL", "url", url)
+			start := time.Now()
 			title := ""
+			var err error
 			if strings.HasSuffix(strings.ToLower(url), ".pdf") {
-				title = PDFTitleGet(url)
+				title = PDFTitleGet(ctx, url)
 			} else {
-				c := http.Client{Timeout: 10 * time.Second}
-				title, _, _ = TitleGet(&c, url)
+				client := http.Client{Timeout: 10 * time.Second}
+				title, _, err = TitleGet(ctx, &client, url)
 			}
-			if !IsIn(title, pointlessTitles) {
+			outcome := "ok"
+			switch {
+			case err != nil:
+				outcome = "error"
+			case title == "":
+				outcome = "no_title"
+			case IsIn(title, c.Urifind.PointlessTitles):
+				outcome = "pointless"
+			}
+			titleFetches.WithLabelValues(metricsDomain(url), outcome).Observe(time.Since(start).Seconds())
+			if !IsIn(title, c.Urifind.PointlessTitles) {
 				postTitle(parsed, title, "")
 				cacheAdd(url, title)
 			}
-		}(url)
+		})
 	}
 	return nil
 }
@@ -175,29 +175,23 @@ func extract(msg string) []string {
 
 // PDF stuff ///////////////////////////////////////////////////////////
 
-func PDFTitleGet(url string) string {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("Coding error in PDFTitleGet: %v", r)
-		}
-	}()
-
+func PDFTitleGet(ctx context.Context, url string) string {
 	c := http.Client{Timeout: 10 * time.Second}
-	gTitle, _, gErr := TitleGet(&c, "https://webcache.googleusercontent.com/search?q=cache:"+url)
+	gTitle, _, gErr := TitleGet(ctx, &c, "https://webcache.googleusercontent.com/search?q=cache:"+url)
 	if gErr == nil && len(gTitle) > 0 {
 		return gTitle
 	}
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		log.Printf("WTF: could not make http request %s: %s", url, err)
+		urifindLog.Warn("could not make HTTP request", "url", url, "err", err)
 		return ""
 	}
 	req.Header.Set("User-Agent", "frank IRC Bot")
 
-	r, err := c.Do(req)
+	r, err := c.Do(req.WithContext(ctx))
 	if err != nil {
-		log.Printf("WTF: could not resolve %s: %s", url, err)
+		urifindLog.Warn("could not resolve URL", "url", url, "err", err)
 		return ""
 	}
 	defer r.Body.Close()
@@ -258,17 +252,17 @@ type Doer interface {
 	Do(*http.Request) (*http.Response, error)
 }
 
-func TitleGet(doer Doer, url string) (string, string, error) {
+func TitleGet(ctx context.Context, doer Doer, url string) (string, string, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		log.Printf("WTF: could not make http request %s: %s", url, err)
+		urifindLog.Warn("could not make HTTP request", "url", url, "err", err)
 		return "", url, err
 	}
 	req.Header.Set("User-Agent", "frank IRC Bot")
 
-	r, err := doer.Do(req)
+	r, err := doer.Do(req.WithContext(ctx))
 	if err != nil {
-		log.Printf("WTF: could not resolve %s: %s", url, err)
+		urifindLog.Warn("could not resolve URL", "url", url, "err", err)
 		return "", url, err
 	}
 	// from https://github.com/gaul/anaconda/commit/ba67efed60e7dcf8a96fd9053531fc1d517fd7df
@@ -290,7 +284,7 @@ func TitleGet(doer Doer, url string) (string, string, error) {
 
 	bytesRead, err := io.ReadFull(r.Body, head)
 	if err != nil && err != io.ErrUnexpectedEOF {
-		log.Printf("Could not read from %s: %s", url, err)
+		urifindLog.Warn("could not read", "url", url, "err", err)
 		return "", url, err
 	}
 
@@ -307,14 +301,14 @@ func TitleGet(doer Doer, url string) (string, string, error) {
 	}
 
 	if len(title) > titleMaxAllowedLength {
-		title = title[:titleMaxAllowedLength]
+		title = title[:runeBoundary(title, titleMaxAllowedLength)]
 	}
 
 	if r.StatusCode != 200 {
 		return "", lastUrl, errors.New("[" + strconv.Itoa(r.StatusCode) + "] " + title)
 	}
 
-	log.Printf("Title for URL %s: %s", url, title)
+	urifindLog.Debug("found title", "url", url, "title", title)
 
 	return title, lastUrl, nil
 }
@@ -348,19 +342,98 @@ type Cache struct {
 	date  time.Time
 }
 
-var cache = [cacheSize]Cache{}
-var cacheIndex = 0
+// ring buffer of the recently posted titles, shared by all URL lookups
+var cache = struct {
+	mtx     sync.Mutex
+	entries [cacheSize]Cache
+	index   int
+}{}
+
+const linkCacheNamespace = "link-cache"
+
+// linkCacheEntry is how a Cache is persisted.
+type linkCacheEntry struct {
+	URL   string    `json:"url"`
+	Title string    `json:"title"`
+	Date  time.Time `json:"date"`
+}
 
 func cacheAdd(url string, title string) {
-	if len(cache) == cacheIndex {
-		cacheIndex = 0
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	if len(cache.entries) == cache.index {
+		cache.index = 0
+	}
+	cc := Cache{url, title, time.Now()}
+	cache.entries[cache.index] = cc
+	// entries are stored by their position, overwriting the oldest one
+	key := fmt.Sprintf("%03d", cache.index)
+	cache.index += 1
+
+	err := store.Update(func(tx Tx) error {
+		return putJSON(tx, linkCacheNamespace, key, linkCacheEntry{cc.url, cc.title, cc.date})
+	})
+	if err != nil {
+		urifindLog.Error("could not store link cache", "err", err)
 	}
-	cache[cacheIndex] = Cache{url, title, time.Now()}
-	cacheIndex += 1
 }
 
+// loadLinkCache restores the cache from the store. The stored entries are
+// renumbered oldest first, so that positions and keys match again.
+func loadLinkCache() {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	var stored []linkCacheEntry
+	err := store.Update(func(tx Tx) error {
+		var keys []string
+		err := tx.ForEach(linkCacheNamespace, func(key string, value []byte) error {
+			var e linkCacheEntry
+			if err := json.Unmarshal(value, &e); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			keys = append(keys, key)
+			stored = append(stored, e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := tx.Delete(linkCacheNamespace, key); err != nil {
+				return err
+			}
+		}
+
+		sort.Slice(stored, func(i, j int) bool {
+			return stored[i].Date.Before(stored[j].Date)
+		})
+		if len(stored) > cacheSize {
+			stored = stored[len(stored)-cacheSize:]
+		}
+		for i, e := range stored {
+			if err := putJSON(tx, linkCacheNamespace, fmt.Sprintf("%03d", i), e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		urifindLog.Error("could not read link cache", "err", err)
+		return
+	}
+
+	for i, e := range stored {
+		cache.entries[i] = Cache{e.URL, e.Title, e.Date}
+	}
+	cache.index = len(stored) % cacheSize
+}
+
+// cacheGetByUrl returns a copy of the cache entry for url, or nil.
 func cacheGetByUrl(url string) *Cache {
-	for _, cc := range cache {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	for _, cc := range cache.entries {
 		if cc.url == url && time.Since(cc.date).Hours() <= cacheValidHours {
 			return &cc
 		}
@@ -379,8 +452,10 @@ func cacheGetTimeAgo(cc *Cache) string {
 }
 
 func cacheGetSecondsToLastPost(title string) int {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
 	var secondsAgo = int(^uint(0) >> 1)
-	for _, cc := range cache {
+	for _, cc := range cache.entries {
 		var a = int(time.Since(cc.date).Seconds())
 		if cc.title == title && a < secondsAgo {
 			secondsAgo = a
@@ -391,20 +466,16 @@ func cacheGetSecondsToLastPost(title string) int {
 
 // util ////////////////////////////////////////////////////////////////
 
-func postTitle(parsed *irc.Message, title string, prefix string) {
+func postTitle(parsed *Message, title string, prefix string) {
 	tgt := Target(parsed)
 
 	secondsAgo := cacheGetSecondsToLastPost(title)
 	if secondsAgo <= noRepostWithinSeconds {
-		log.Printf("Skipping, because posted %d seconds ago (“%s”)", secondsAgo, title)
+		urifindLog.Debug("skipping recently posted title", "seconds_ago", secondsAgo, "title", title)
 		return
 	}
 
-	if *verbose {
-		log.Printf("Title was last posted: %#v (“%s”)", secondsAgo, title)
-	}
-
-	log.Printf("nick=%s, target=%s, title=%s", Nick(parsed), tgt, title)
+	urifindLog.Info("posting title", "nick", Nick(parsed), "target", tgt, "title", title, "last_posted_seconds_ago", secondsAgo)
 	// if target is our current nick, it was a private message.
 	// Answer the users in this case.
 	if IsPrivateQuery(parsed) {
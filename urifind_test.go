@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -23,7 +24,7 @@ func TestPDFTitleGet(t *testing.T) {
 		}))
 		defer ts.Close()
 
-		title := PDFTitleGet(ts.URL)
+		title := PDFTitleGet(context.Background(), ts.URL)
 		if title != expected {
 			t.Errorf("TestPDFTitleGet(%v)\n GOT: %v\nWANT: %v", "from", title, expected)
 		}
@@ -115,7 +116,7 @@ func TestTitleGet(t *testing.T) {
 		t.Run(want.title, func(t *testing.T) {
 			t.Parallel()
 			sd := stringDoer(want.body)
-			if got, _, _ := TitleGet(&sd, irrelevantURL); !strings.HasSuffix(got, want.title) {
+			if got, _, _ := TitleGet(context.Background(), &sd, irrelevantURL); !strings.HasSuffix(got, want.title) {
 				t.Errorf("unexpected title: got %q, want %q suffix", got, want.title)
 			}
 		})